@@ -0,0 +1,149 @@
+package sdk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive"
+	"github.com/fatih/color"
+)
+
+// ArchiveSource provides an embeddable Source field for the reserved
+// `archive` source key, which the sdk uses to automatically initialize a
+// version archive for resources that do not implement Archiver
+type ArchiveSource struct {
+	Archive *archive.Config `json:"archive,omitempty"`
+}
+
+// newArchive initializes a version archive, preferring a custom archive
+// returned by the resource's Archive method if implemented, and falling back
+// to an archive built from the reserved `archive` source key. If the archive
+// is namespaced using the resource identity, newArchive also returns a
+// function that copies history archived without a namespace into the
+// namespaced archive, which should be invoked while holding the archive lock.
+func newArchive[Source any](ctx context.Context, r any, source *Source, cfg *archive.Config) (Archive, func(context.Context) error, error) {
+	if a, ok := r.(Archiver[Source]); ok {
+		archiver, err := a.Archive(ctx, source)
+		if err != nil || archiver != nil {
+			return archiver, nil, err
+		}
+	}
+
+	if cfg == nil {
+		return nil, nil, nil
+	}
+	Debugf(ctx, "initializing archive from source config")
+
+	// namespace archived history using the resource identity, unless a
+	// namespace is configured explicitly
+	c := *cfg
+	if c.Namespace != "" {
+		Debugf(ctx, "using configured archive namespace %s", c.Namespace)
+		a, err := archive.New(ctx, c)
+		return a, nil, err
+	}
+	id, fields, err := identity(source)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error deriving resource identity: %w", err)
+	}
+	if id == "" {
+		a, err := archive.New(ctx, c)
+		return a, nil, err
+	}
+	color.Yellow("using archive namespace %s, derived from source fields: %s", id, strings.Join(fields, ", "))
+	c.Namespace = id
+	a, err := archive.New(ctx, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, func(ctx context.Context) error {
+		return adoptLegacy(ctx, a, id, *cfg)
+	}, nil
+}
+
+// adoptLegacy copies the history (and metadata) of the un-namespaced archive
+// described by cfg into an empty namespaced archive, so that adding identity
+// fields to a resource never discards history archived before the namespace
+// was derived. Once copied, the namespaced archive is no longer empty, and the
+// un-namespaced archive is neither read nor written again.
+func adoptLegacy(ctx context.Context, namespaced archive.Archive, namespace string, cfg archive.Config) (err error) {
+	if empty, err := isEmpty(ctx, namespaced); err != nil {
+		return fmt.Errorf("error reading archive namespace %s: %w", namespace, err)
+	} else if !empty {
+		return nil
+	}
+
+	legacy, err := archive.New(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("error initializing un-namespaced archive: %w", err)
+	}
+	defer func() {
+		if cerr := legacy.Close(ctx); err == nil && cerr != nil {
+			err = fmt.Errorf("error closing un-namespaced archive: %w", cerr)
+		}
+	}()
+	entries, err := archive.List(ctx, legacy)
+	if err != nil {
+		return fmt.Errorf("error reading un-namespaced archive: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	versions := make([][]byte, len(entries))
+	for i, e := range entries {
+		versions[i] = e.Version
+	}
+	if err := namespaced.Put(ctx, versions...); err != nil {
+		return fmt.Errorf("error copying un-namespaced history: %w", err)
+	}
+	for _, version := range versions {
+		meta, err := archive.GetMetadata(ctx, legacy, version)
+		if err != nil {
+			return fmt.Errorf("error reading un-namespaced metadata: %w", err)
+		}
+		if meta == nil {
+			continue
+		}
+		if err := archive.PutMetadata(ctx, namespaced, version, meta); err != nil {
+			return fmt.Errorf("error copying un-namespaced metadata: %w", err)
+		}
+	}
+	color.Yellow("copied %d version(s) archived without a namespace into empty archive namespace %s", len(versions), namespace)
+	return nil
+}
+
+// isEmpty returns true if an archive contains no versions
+func isEmpty(ctx context.Context, a archive.Archive) (empty bool, err error) {
+	empty = true
+	archive.HistoryIter(ctx, a, nil, 1)(func(_ []byte, e error) bool {
+		empty, err = false, e
+		return false
+	})
+	return empty, err
+}
+
+// toArchiveMetadata converts resource metadata into archived metadata
+func toArchiveMetadata(meta []Metadata) []archive.Metadata {
+	if meta == nil {
+		return nil
+	}
+	result := make([]archive.Metadata, len(meta))
+	for i, m := range meta {
+		result[i] = archive.Metadata{Name: m.Name, Value: m.Value}
+	}
+	return result
+}
+
+// fromArchiveMetadata converts archived metadata into resource metadata
+func fromArchiveMetadata(meta []archive.Metadata) []Metadata {
+	if meta == nil {
+		return nil
+	}
+	result := make([]Metadata, len(meta))
+	for i, m := range meta {
+		result[i] = Metadata{Name: m.Name, Value: m.Value}
+	}
+	return result
+}
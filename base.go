@@ -2,10 +2,18 @@ package sdk
 
 import (
 	"context"
-	"errors"
+	"fmt"
 )
 
-// BaseResource provides an embeddable Resource implementation with noops for optional methods
+// BaseResource provides an embeddable Resource implementation with noops for
+// the optional Archive, Close, and Initialize methods, and stubs for the
+// Check, In, and Out methods that fail when invoked.
+//
+// Deprecated: the optional Archive, Close, and Initialize methods are detected
+// individually by Exec, and resources that do not support an operation should
+// embed UnsupportedCheck, UnsupportedGet, or UnsupportedPut instead, which
+// fail before any resource or archive initialization. It is retained for
+// backwards compatibility.
 type BaseResource[Source any, Version any, GetParams any, PutParams any] struct{}
 
 func (r *BaseResource[Source, Version, GetParams, PutParams]) Archive(ctx context.Context, s *Source) (Archive, error) {
@@ -21,14 +29,53 @@ func (r *BaseResource[Source, Version, GetParams, PutParams]) Initialize(ctx con
 }
 
 func (r *BaseResource[Source, Version, GetParams, PutParams]) Check(ctx context.Context, s *Source, v *Version) ([]Version, error) {
-	return nil, errors.New("not implemented")
+	return nil, errUnsupported(CheckOp)
 }
 
 func (r *BaseResource[Source, Version, GetParams, PutParams]) In(ctx context.Context, s *Source, v *Version, path string, p *GetParams) ([]Metadata, error) {
-	return nil, errors.New("not implemented")
+	return nil, errUnsupported(InOp)
 }
 
-func (r *BaseResource[Source, Version, GetParams, PutParams]) Out(ctx context.Context, s *Source, path string, p *GetParams) (Version, []Metadata, error) {
+func (r *BaseResource[Source, Version, GetParams, PutParams]) Out(ctx context.Context, s *Source, path string, p *PutParams) (Version, []Metadata, error) {
 	var v Version
-	return v, nil, errors.New("not implemented")
+	return v, nil, errUnsupported(OutOp)
+}
+
+// UnsupportedCheck can be embedded by resources that do not support check
+// operations, which fail with a descriptive error before any resource or
+// archive initialization
+type UnsupportedCheck[Source any, Version any] struct{}
+
+func (UnsupportedCheck[Source, Version]) Check(context.Context, *Source, *Version) ([]Version, error) {
+	return nil, errUnsupported(CheckOp)
+}
+
+func (UnsupportedCheck[Source, Version]) checkUnsupported() {}
+
+// UnsupportedGet can be embedded by resources that do not support get steps,
+// which fail with a descriptive error before any resource or archive
+// initialization
+type UnsupportedGet[Source any, Version any, GetParams any] struct{}
+
+func (UnsupportedGet[Source, Version, GetParams]) In(context.Context, *Source, *Version, string, *GetParams) ([]Metadata, error) {
+	return nil, errUnsupported(InOp)
+}
+
+func (UnsupportedGet[Source, Version, GetParams]) getUnsupported() {}
+
+// UnsupportedPut can be embedded by resources that do not support put steps,
+// which fail with a descriptive error before any resource or archive
+// initialization
+type UnsupportedPut[Source any, Version any, PutParams any] struct{}
+
+func (UnsupportedPut[Source, Version, PutParams]) Out(context.Context, *Source, string, *PutParams) (v Version, meta []Metadata, err error) {
+	return v, nil, errUnsupported(OutOp)
+}
+
+func (UnsupportedPut[Source, Version, PutParams]) putUnsupported() {}
+
+// errUnsupported returns the error produced when invoking an operation that a
+// resource does not support
+func errUnsupported(op Op) error {
+	return fmt.Errorf("this resource does not support %s", op)
 }
@@ -0,0 +1,17 @@
+// Command concourse-archive inspects, exports, imports, and deletes archived
+// version history for any of the built-in archive backends.
+package main
+
+import (
+	"github.com/cludden/concourse-go-sdk/pkg/archive/cli"
+
+	// register built-in archive backends not registered by the archive package
+	_ "github.com/cludden/concourse-go-sdk/pkg/archive/file"
+	_ "github.com/cludden/concourse-go-sdk/pkg/archive/redis"
+	_ "github.com/cludden/concourse-go-sdk/pkg/archive/s3"
+	_ "github.com/cludden/concourse-go-sdk/pkg/archive/sql"
+)
+
+func main() {
+	cli.Main()
+}
@@ -10,6 +10,7 @@ type contextKey int
 
 const (
 	stderrKey contextKey = iota
+	optionsKey
 )
 
 // ContextWithStdErr returns a child context with the resource's configured
@@ -26,3 +27,18 @@ func StdErrFromContext(ctx context.Context) io.Writer {
 	}
 	return os.Stderr
 }
+
+// ContextWithOptions returns a child context with the common sdk options
+// parsed from the reserved `sdk` source key
+func ContextWithOptions(ctx context.Context, opts *Options) context.Context {
+	return context.WithValue(ctx, optionsKey, opts)
+}
+
+// OptionsFromContext extracts the common sdk options from the given context
+// value, returning nil if none are present
+func OptionsFromContext(ctx context.Context) *Options {
+	if opts, ok := ctx.Value(optionsKey).(*Options); ok {
+		return opts
+	}
+	return nil
+}
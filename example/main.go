@@ -49,9 +49,7 @@ func (v *Version) Validate(context.Context) error {
 
 // =============================================================================
 
-type Resource struct {
-	sdk.BaseResource[Source, Version, GetParams, PutParams]
-}
+type Resource struct{}
 
 func (r *Resource) Initialize(ctx context.Context, source *Source) (err error) {
 	return nil
@@ -0,0 +1,113 @@
+package sdk
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+)
+
+const (
+	identityTag   = "archive"
+	identityValue = "identity"
+	identitySize  = 8
+)
+
+// Identity returns a stable identifier for a resource, derived from the
+// canonical hash of the source fields tagged with `archive:"identity"`, or
+// an empty string if no fields are tagged. The sdk uses the identity as the
+// archive namespace, allowing many resources to share the same archive
+// storage (e.g. a single boltdb object or database) without sharing history:
+//
+//	type Source struct {
+//		sdk.ArchiveSource
+//		Repository string `json:"repository" archive:"identity"`
+//		Branch     string `json:"branch" archive:"identity"`
+//		Token      string `json:"token"`
+//	}
+//
+// Fields are identified by their json names, with embedded structs flattened
+// in place, so renaming a tagged field or its json name changes the identity.
+func Identity(source any) (string, error) {
+	id, _, err := identity(source)
+	return id, err
+}
+
+// identity returns the resource identity along with the json names of the
+// fields from which it was derived
+func identity(source any) (string, []string, error) {
+	rv := reflect.ValueOf(source)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return "", nil, nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return "", nil, nil
+	}
+
+	values := make(map[string]any)
+	var fields []string
+	if err := appendIdentity(values, &fields, rv); err != nil {
+		return "", nil, err
+	}
+	if len(fields) == 0 {
+		return "", nil, nil
+	}
+
+	b, err := canonical.Marshal(values)
+	if err != nil {
+		return "", nil, fmt.Errorf("error serializing identity fields: %w", err)
+	}
+	sum, err := canonical.Hash(b)
+	if err != nil {
+		return "", nil, fmt.Errorf("error hashing identity fields: %w", err)
+	}
+	return hex.EncodeToString(sum[:identitySize]), fields, nil
+}
+
+// appendIdentity collects the values of each identity field in the given
+// struct value, keyed by json name
+func appendIdentity(values map[string]any, fields *[]string, rv reflect.Value) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		fv := rv.Field(i)
+		tagged := field.Tag.Get(identityTag) == identityValue
+
+		if field.Anonymous && !tagged {
+			for fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					break
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				if err := appendIdentity(values, fields, fv); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !tagged {
+			continue
+		}
+		if !field.IsExported() {
+			return fmt.Errorf("invalid identity field %s: field must be exported", field.Name)
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			name = field.Name
+		}
+		if _, ok := values[name]; ok {
+			return fmt.Errorf("invalid identity field %s: duplicate name %s", field.Name, name)
+		}
+		values[name] = fv.Interface()
+		*fields = append(*fields, name)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package sdk
+
+import (
+	"encoding"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Default metadata limits applied by NewMetadata
+const (
+	DefaultMetadataMaxValueLength = 1024
+	DefaultMetadataMaxEntries     = 32
+)
+
+// MetadataOption customizes the behavior of NewMetadata
+type MetadataOption func(*metadataOptions)
+
+type metadataOptions struct {
+	maxEntries     int
+	maxValueLength int
+	timeLayout     string
+}
+
+// WithMetadataMaxEntries limits the number of metadata entries returned by
+// NewMetadata, where a value less than or equal to zero disables the limit
+func WithMetadataMaxEntries(n int) MetadataOption {
+	return func(o *metadataOptions) {
+		o.maxEntries = n
+	}
+}
+
+// WithMetadataMaxValueLength limits the length (in bytes) of each metadata
+// value, truncating longer values with a trailing ellipsis, where a value less
+// than or equal to zero disables the limit
+func WithMetadataMaxValueLength(n int) MetadataOption {
+	return func(o *metadataOptions) {
+		o.maxValueLength = n
+	}
+}
+
+// WithMetadataTimeLayout overrides the default layout (time.RFC3339) used to
+// format time.Time values without an explicit format tag option
+func WithMetadataTimeLayout(layout string) MetadataOption {
+	return func(o *metadataOptions) {
+		o.timeLayout = layout
+	}
+}
+
+const (
+	metadataEllipsis  = "..."
+	metadataTag       = "metadata"
+	metadataTagFormat = "format="
+	metadataTagIgnore = "-"
+	metadataTagOmit   = "omitempty"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+	urlType      = reflect.TypeOf(url.URL{})
+)
+
+// NewMetadata converts a struct (or pointer to struct) into a list of resource
+// metadata, allowing resources to describe metadata using typed values instead
+// of hand built []Metadata literals. Entries are returned in field declaration
+// order, with embedded structs flattened in place. Field behavior can be
+// customized using a `metadata` struct tag:
+//
+//	type Meta struct {
+//		Commit    string        `metadata:"commit"`
+//		Author    string        `metadata:"author,omitempty"`
+//		Committed time.Time     `metadata:"committed,format=2006-01-02"`
+//		Duration  time.Duration // name defaults to "duration"
+//		Internal  string        `metadata:"-"`
+//	}
+//
+// Fields without a name default to the snake_cased field name. Times are
+// formatted as RFC3339 unless a format option is provided, and urls, numbers,
+// durations, fmt.Stringer and encoding.TextMarshaler implementations are
+// formatted using their canonical string representations. Values that exceed
+// the configured maximum length are truncated.
+func NewMetadata(v any, opts ...MetadataOption) ([]Metadata, error) {
+	o := metadataOptions{
+		maxEntries:     DefaultMetadataMaxEntries,
+		maxValueLength: DefaultMetadataMaxValueLength,
+		timeLayout:     time.RFC3339,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil, nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("invalid metadata: expected struct, got: %s", rv.Kind())
+	}
+
+	var meta []Metadata
+	if err := appendMetadata(&meta, rv, &o); err != nil {
+		return nil, err
+	}
+	if o.maxEntries > 0 && len(meta) > o.maxEntries {
+		meta = meta[:o.maxEntries]
+	}
+	return meta, nil
+}
+
+// appendMetadata appends metadata entries for each exported field in the
+// given struct value
+func appendMetadata(meta *[]Metadata, rv reflect.Value, o *metadataOptions) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		tag := field.Tag.Get(metadataTag)
+		if tag == metadataTagIgnore {
+			continue
+		}
+
+		fv := rv.Field(i)
+		if field.Anonymous && tag == "" && indirectType(field.Type).Kind() == reflect.Struct {
+			// nil embedded struct pointers contribute no entries
+			for fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					break
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Pointer {
+				continue
+			}
+			if fv.Kind() == reflect.Struct {
+				if err := appendMetadata(meta, fv, o); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = snakeCase(field.Name)
+		}
+		var omitempty bool
+		layout := o.timeLayout
+		for _, opt := range strings.Split(opts, ",") {
+			switch {
+			case opt == metadataTagOmit:
+				omitempty = true
+			case strings.HasPrefix(opt, metadataTagFormat):
+				layout = strings.TrimPrefix(opt, metadataTagFormat)
+			}
+		}
+
+		if omitempty && isEmptyMetadataValue(fv) {
+			continue
+		}
+		value, err := formatMetadataValue(fv, layout)
+		if err != nil {
+			return fmt.Errorf("invalid metadata field %s: %w", field.Name, err)
+		}
+		*meta = append(*meta, Metadata{
+			Name:  name,
+			Value: truncateMetadataValue(value, o.maxValueLength),
+		})
+	}
+	return nil
+}
+
+// indirectType returns the type obtained by dereferencing t until it is no
+// longer a pointer type
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+// formatMetadataValue returns the string representation of a metadata value
+func formatMetadataValue(v reflect.Value, layout string) (string, error) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+
+	switch v.Type() {
+	case timeType:
+		return v.Interface().(time.Time).Format(layout), nil
+	case durationType:
+		return v.Interface().(time.Duration).String(), nil
+	case urlType:
+		u := v.Interface().(url.URL)
+		return u.String(), nil
+	}
+	if v.CanInterface() {
+		if s, ok := v.Interface().(fmt.Stringer); ok {
+			return s.String(), nil
+		}
+		if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+			b, err := m.MarshalText()
+			return string(b), err
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 32), nil
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64), nil
+	case reflect.Slice, reflect.Array:
+		items := make([]string, v.Len())
+		for i := range items {
+			item, err := formatMetadataValue(v.Index(i), layout)
+			if err != nil {
+				return "", err
+			}
+			items[i] = item
+		}
+		return strings.Join(items, ", "), nil
+	default:
+		return "", fmt.Errorf("unsupported type: %s", v.Type())
+	}
+}
+
+// isEmptyMetadataValue reports whether v is the zero value for its type
+func isEmptyMetadataValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
+
+// truncateMetadataValue truncates s to at most n bytes without splitting a
+// multi-byte character
+func truncateMetadataValue(s string, n int) string {
+	if n <= 0 || len(s) <= n {
+		return s
+	}
+	if n <= len(metadataEllipsis) {
+		return metadataEllipsis[:n]
+	}
+	end := n - len(metadataEllipsis)
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end] + metadataEllipsis
+}
+
+// snakeCase converts a go field name into snake case (e.g. CommitURL => commit_url)
+func snakeCase(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
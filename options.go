@@ -0,0 +1,165 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/fatih/color"
+	"github.com/tidwall/gjson"
+)
+
+type (
+	// CommonSource provides an embeddable Source field for the reserved `sdk`
+	// source key, which carries cross-cutting options supported by every
+	// resource
+	CommonSource struct {
+		SDK *Options `json:"sdk,omitempty"`
+	}
+
+	// Duration describes a time.Duration that can be parsed from a json
+	// duration string (e.g. "1m30s"), shared with archive settings
+	Duration = settings.Duration
+
+	// Options describes cross-cutting configuration supported by every
+	// resource via the reserved `sdk` source key
+	Options struct {
+		// Archive configures automatic version archiving, and is equivalent to
+		// the reserved `archive` source key
+		Archive *archive.Config `json:"archive,omitempty"`
+		// ArchivedMetadata enables get steps to return the metadata archived
+		// alongside a version by a previous put step when the resource returns
+		// no metadata, such as when the resource can no longer recompute it
+		ArchivedMetadata bool `json:"archived_metadata"`
+		// Color enables or disables colorized output (enabled by default)
+		Color *bool `json:"color,omitempty"`
+		// Debug enables debug logging
+		Debug bool `json:"debug"`
+		// Retry configures retries of failed check operations and get steps
+		Retry *RetryPolicy `json:"retry,omitempty"`
+		// Strict enables strict decoding of source, version, and params values,
+		// rejecting unknown fields
+		Strict bool `json:"strict"`
+		// Timeout limits the total duration of the operation
+		Timeout Duration `json:"timeout"`
+	}
+
+	// RetryPolicy describes the retry behavior of failed check operations and
+	// get steps. Put steps are never retried, as they are not guaranteed to be
+	// idempotent.
+	RetryPolicy struct {
+		// The maximum number of attempts, including the first
+		Attempts int `json:"attempts"`
+		// The delay before the first retry, which doubles after each
+		// subsequent attempt (defaults to 1s)
+		Delay Duration `json:"delay"`
+		// The maximum delay in between attempts
+		MaxDelay Duration `json:"max_delay"`
+	}
+)
+
+// reserved source keys
+const (
+	archiveKey = "archive"
+	sdkKey     = "sdk"
+)
+
+// Debugf writes a formatted debug message to the resource's stderr writer if
+// debug logging is enabled via the reserved `sdk` source key
+func Debugf(ctx context.Context, format string, args ...any) {
+	if opts := OptionsFromContext(ctx); opts == nil || !opts.Debug {
+		return
+	}
+	color.New(color.FgHiBlack).Fprintf(StdErrFromContext(ctx), "[debug] "+format+"\n", args...)
+}
+
+// parseOptions parses common sdk options from the reserved `sdk` source key,
+// falling back to the reserved `archive` source key for archive config
+func parseOptions(source gjson.Result) (*Options, error) {
+	opts := &Options{}
+	if x := source.Get(sdkKey); x.Exists() && x.Type != gjson.Null {
+		if err := json.Unmarshal([]byte(x.Raw), opts); err != nil {
+			return nil, fmt.Errorf("error parsing sdk options: %w", err)
+		}
+	}
+	if x := source.Get(archiveKey); opts.Archive == nil && x.Exists() && x.Type != gjson.Null {
+		if err := json.Unmarshal([]byte(x.Raw), &opts.Archive); err != nil {
+			return nil, fmt.Errorf("error parsing archive config: %w", err)
+		}
+	}
+	if opts.Retry != nil && opts.Retry.Attempts < 0 {
+		return nil, fmt.Errorf("invalid sdk options: retry attempts must be non-negative")
+	}
+	return opts, nil
+}
+
+// decode parses a raw json value into v, rejecting unknown fields if strict
+// decoding is enabled. Any reserved keys are ignored during strict decoding.
+func decode[T any](ctx context.Context, raw gjson.Result, reserved ...string) (*T, error) {
+	var v T
+	if err := json.Unmarshal([]byte(raw.Raw), &v); err != nil {
+		return nil, err
+	}
+
+	if opts := OptionsFromContext(ctx); opts == nil || !opts.Strict {
+		return &v, nil
+	}
+
+	b := []byte(raw.Raw)
+	if len(reserved) > 0 && raw.IsObject() {
+		fields := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return nil, err
+		}
+		for _, key := range reserved {
+			delete(fields, key)
+		}
+		var err error
+		if b, err = json.Marshal(fields); err != nil {
+			return nil, err
+		}
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(new(T)); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// retry invokes fn until it succeeds or the retry policy configured via the
+// reserved `sdk` source key is exhausted
+func retry(ctx context.Context, op Op, fn func() error) error {
+	var policy RetryPolicy
+	if opts := OptionsFromContext(ctx); opts != nil && opts.Retry != nil {
+		policy = *opts.Retry
+	}
+	delay := time.Duration(policy.Delay)
+	if delay <= 0 {
+		delay = time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.Attempts {
+			return err
+		}
+
+		color.Yellow("%s attempt %d of %d failed, retrying in %s: %v", op, attempt, policy.Attempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if max := time.Duration(policy.MaxDelay); max > 0 && delay > max {
+			delay = max
+		}
+	}
+}
@@ -2,18 +2,51 @@ package archive
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/cludden/concourse-go-sdk/pkg/archive/boltdb"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/history"
 	"github.com/cludden/concourse-go-sdk/pkg/archive/inmem"
 	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
 	"github.com/go-playground/validator/v10"
 )
 
+// The inmem backend, along with the boltdb backend for backwards
+// compatibility, is registered by this package. All other built-in backends
+// register themselves when imported, which allows resources to link only the
+// backends (and dependencies) they use:
+//
+//	import _ "github.com/cludden/concourse-go-sdk/pkg/archive/s3"
+func init() {
+	Register("boltdb", NewFactory(boltdb.New))
+	Register("inmem", NewFactory(inmem.New))
+	Register("replicated", NewFactory(NewReplicated))
+}
+
+// Config describes archive configuration, consisting of common settings and
+// exactly one backend config keyed by the backend's registered name
 type Config struct {
-	settings.Settings `json:",inline" validate:"dive"`
-	BoltDB            *boltdb.Config `json:"boltdb" validate:"omitempty"`
-	Inmem             *inmem.Config  `json:"inmem" validate:"omitempty"`
+	settings.Settings `json:",inline"`
+	// Backends contains the raw configuration of each configured backend,
+	// keyed by registered backend name
+	Backends map[string]json.RawMessage `json:"-"`
+	// BoltDB configures the boltdb backend.
+	//
+	// Deprecated: set Backends["boltdb"] instead. BoltDB is merged into
+	// Backends by New and MarshalJSON, and is never populated when decoding
+	// json.
+	BoltDB *boltdb.Config `json:"-"`
+	// Inmem configures the inmem backend.
+	//
+	// Deprecated: set Backends["inmem"] instead. Inmem is merged into Backends
+	// by New and MarshalJSON, and is never populated when decoding json.
+	Inmem *inmem.Config `json:"-"`
 }
 
 type Archive interface {
@@ -22,17 +55,281 @@ type Archive interface {
 	Put(ctx context.Context, versions ...[]byte) error
 }
 
+// Seq is an iterator over archived versions, ordered oldest first
+type Seq = history.Seq
+
+// Iterable describes an Archive that supports streaming version history
+// without loading it into memory
+type Iterable interface {
+	// HistoryIter returns an iterator over the same versions returned by
+	// History, reading at most pageSize versions into memory at a time, or a
+	// backend specific default if pageSize is zero
+	HistoryIter(ctx context.Context, latest []byte, pageSize int) Seq
+}
+
+// HistoryIter returns an iterator over an archive's version history,
+// streaming versions if the archive implements Iterable, and falling back to
+// History otherwise
+func HistoryIter(ctx context.Context, a Archive, latest []byte, pageSize int) Seq {
+	if i, ok := a.(Iterable); ok {
+		return i.HistoryIter(ctx, latest, pageSize)
+	}
+	return func(yield func([]byte, error) bool) {
+		versions, err := a.History(ctx, latest)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		history.Slice(versions)(yield)
+	}
+}
+
+// Entry describes an archived version along with the time it was archived,
+// which is zero if unknown
+type Entry = history.Entry
+
+// Lister describes an Archive that supports listing all archived versions
+// along with the time each was archived
+type Lister interface {
+	// List returns all archived versions ordered oldest first, regardless of
+	// the configured history settings
+	List(ctx context.Context) ([]Entry, error)
+}
+
+// Finder describes an Archive that supports checking whether a specific
+// version has been archived without reading its full history
+type Finder interface {
+	// Has returns true if the given version has been archived
+	Has(ctx context.Context, version []byte) (bool, error)
+}
+
+// Deleter describes an Archive that supports removing specific versions
+type Deleter interface {
+	// Delete removes the given versions from the archive, ignoring versions
+	// that have not been archived, and returns the number of versions removed
+	Delete(ctx context.Context, versions ...[]byte) (int, error)
+}
+
+// Metadata describes a single name/value pair of resource metadata archived
+// alongside a version
+type Metadata = history.Metadata
+
+// MetadataStore describes an Archive that supports persisting resource
+// metadata alongside archived versions
+type MetadataStore interface {
+	// PutMetadata archives a version along with its metadata, replacing any
+	// metadata previously archived alongside the version
+	PutMetadata(ctx context.Context, version []byte, metadata []Metadata) error
+	// Metadata returns the metadata archived alongside the given version, or
+	// nil if the version or its metadata has not been archived
+	Metadata(ctx context.Context, version []byte) ([]Metadata, error)
+}
+
+// List returns all versions in an archive along with the time each was
+// archived, falling back to History with unknown archive times if the archive
+// does not implement Lister
+func List(ctx context.Context, a Archive) ([]Entry, error) {
+	if l, ok := a.(Lister); ok {
+		return l.List(ctx)
+	}
+	versions, err := a.History(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, len(versions))
+	for i, version := range versions {
+		entries[i] = Entry{Version: version}
+	}
+	return entries, nil
+}
+
+// Has returns true if a version has been archived, falling back to scanning
+// the full history if the archive does not implement Finder
+func Has(ctx context.Context, a Archive, version []byte) (found bool, err error) {
+	if f, ok := a.(Finder); ok {
+		return f.Has(ctx, version)
+	}
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return false, fmt.Errorf("error hashing version: %v", err)
+	}
+	HistoryIter(ctx, a, nil, 0)(func(v []byte, e error) bool {
+		if err = e; err != nil {
+			return false
+		}
+		s, e := canonical.Hash(v)
+		if e != nil {
+			err = fmt.Errorf("error hashing archived version: %v", e)
+			return false
+		}
+		found = s == sum
+		return !found
+	})
+	return found, err
+}
+
+// Delete removes the given versions from an archive, returning an error if
+// the archive does not implement Deleter
+func Delete(ctx context.Context, a Archive, versions ...[]byte) (int, error) {
+	d, ok := a.(Deleter)
+	if !ok {
+		return 0, errors.New("archive does not support deleting versions")
+	}
+	return d.Delete(ctx, versions...)
+}
+
+// PutMetadata archives a version along with its metadata, archiving only the
+// version if the archive does not implement MetadataStore
+func PutMetadata(ctx context.Context, a Archive, version []byte, metadata []Metadata) error {
+	if m, ok := a.(MetadataStore); ok {
+		return m.PutMetadata(ctx, version, metadata)
+	}
+	return a.Put(ctx, version)
+}
+
+// GetMetadata returns the metadata archived alongside a version, returning
+// nil if the archive does not implement MetadataStore
+func GetMetadata(ctx context.Context, a Archive, version []byte) ([]Metadata, error) {
+	if m, ok := a.(MetadataStore); ok {
+		return m.Metadata(ctx, version)
+	}
+	return nil, nil
+}
+
 func New(ctx context.Context, cfg Config) (Archive, error) {
-	if err := validator.New().StructCtx(ctx, &cfg); err != nil {
+	if err := validator.New().StructCtx(ctx, &cfg.Settings); err != nil {
 		return nil, fmt.Errorf("invalid config: %v", err)
 	}
 
-	switch {
-	case cfg.BoltDB != nil:
-		return boltdb.New(ctx, *cfg.BoltDB, &cfg.Settings)
-	case cfg.Inmem != nil:
-		return inmem.New(ctx, *cfg.Inmem, &cfg.Settings)
+	backends, err := cfg.backends()
+	if err != nil {
+		return nil, err
+	}
+	name, factory, err := backend(backends)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*encryptionKey
+	if cfg.Encryption != nil {
+		if keys, err = newEncryptionKeys(cfg.Encryption); err != nil {
+			return nil, err
+		}
+	}
+
+	a, err := factory(ctx, backends[name], &cfg.Settings)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing %s archive: %w", name, err)
+	}
+	if keys != nil {
+		a = &encrypted{Archive: a, keys: keys}
+	}
+	return a, nil
+}
+
+// backend returns the name and factory of the single backend configured in
+// backends, returning an error if zero, multiple, or unknown backends are
+// configured
+func backend(backends map[string]json.RawMessage) (string, Factory, error) {
+	available := strings.Join(Backends(), ", ")
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	switch len(names) {
+	case 0:
+		return "", nil, fmt.Errorf("no archive backend configured, expected one of: %s", available)
+	case 1:
 	default:
-		return nil, fmt.Errorf("no valid provider config found")
+		return "", nil, fmt.Errorf("multiple archive backends configured (%s), expected exactly one of: %s", strings.Join(names, ", "), available)
+	}
+
+	factory, ok := lookup(names[0])
+	if !ok {
+		return "", nil, fmt.Errorf("unknown archive backend %q, expected one of: %s", names[0], available)
+	}
+	return names[0], factory, nil
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (c Config) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(c.Settings)
+	if err != nil {
+		return nil, err
+	}
+	backends, err := c.backends()
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage, len(backends))
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for name, raw := range backends {
+		fields[name] = raw
+	}
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface, parsing common
+// settings and treating all other non-null keys as backend configuration
+func (c *Config) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &c.Settings); err != nil {
+		return err
+	}
+
+	reserved := settingsKeys()
+	c.Backends = make(map[string]json.RawMessage)
+	for name, raw := range fields {
+		if _, ok := reserved[name]; ok || string(raw) == "null" {
+			continue
+		}
+		c.Backends[name] = raw
+	}
+	return nil
+}
+
+// backends returns the raw configuration of each configured backend, merging
+// the deprecated BoltDB and Inmem fields into Backends
+func (c Config) backends() (map[string]json.RawMessage, error) {
+	if c.BoltDB == nil && c.Inmem == nil {
+		return c.Backends, nil
+	}
+	backends := make(map[string]json.RawMessage, len(c.Backends)+2)
+	for name, raw := range c.Backends {
+		backends[name] = raw
+	}
+	for name, cfg := range map[string]any{"boltdb": c.BoltDB, "inmem": c.Inmem} {
+		if reflect.ValueOf(cfg).IsNil() {
+			continue
+		}
+		if _, ok := backends[name]; ok {
+			return nil, fmt.Errorf("%s archive backend configured via both Backends and the deprecated config field", name)
+		}
+		raw, err := json.Marshal(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error serializing %s config: %v", name, err)
+		}
+		backends[name] = raw
+	}
+	return backends, nil
+}
+
+// settingsKeys returns the set of json keys used by common settings
+func settingsKeys() map[string]struct{} {
+	keys := make(map[string]struct{})
+	t := reflect.TypeOf(settings.Settings{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			keys[name] = struct{}{}
+		}
 	}
+	return keys
 }
@@ -0,0 +1,302 @@
+package archive_test
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/file"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/inmem"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/stretchr/testify/assert"
+)
+
+type customConfig struct {
+	Name string `json:"name" validate:"required"`
+}
+
+type customArchive struct {
+	*inmem.Archive
+	cfg      customConfig
+	settings *settings.Settings
+}
+
+func init() {
+	archive.Register("custom", archive.NewFactory(func(ctx context.Context, cfg customConfig, s *settings.Settings) (*customArchive, error) {
+		a, err := inmem.New(ctx, inmem.Config{}, s)
+		if err != nil {
+			return nil, err
+		}
+		return &customArchive{Archive: a, cfg: cfg, settings: s}, nil
+	}))
+}
+
+func TestNew(t *testing.T) {
+	cases := map[string]struct {
+		config string
+		assert func(t *testing.T, a archive.Archive, err error)
+	}{
+		"custom": {
+			config: `{"force_history":true,"retention":{"max_versions":10},"custom":{"name":"foo"},"inmem":null}`,
+			assert: func(t *testing.T, a archive.Archive, err error) {
+				if !assert.NoError(t, err) {
+					return
+				}
+				if assert.IsType(t, &customArchive{}, a) {
+					assert.Equal(t, "foo", a.(*customArchive).cfg.Name)
+					assert.True(t, a.(*customArchive).settings.ForceHistory)
+					assert.Equal(t, 10, a.(*customArchive).settings.Retention.MaxVersions)
+				}
+			},
+		},
+		"builtin": {
+			config: `{"inmem":{"history":["{\"id\":\"foo\"}"]}}`,
+			assert: func(t *testing.T, a archive.Archive, err error) {
+				if !assert.NoError(t, err) {
+					return
+				}
+				history, err := a.History(context.Background(), nil)
+				assert.NoError(t, err)
+				assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`)}, history)
+			},
+		},
+		"invalid_backend_config": {
+			config: `{"custom":{}}`,
+			assert: func(t *testing.T, a archive.Archive, err error) {
+				assert.Nil(t, a)
+				assert.EqualError(t, err, "error initializing custom archive: invalid config: Key: 'customConfig.Name' Error:Field validation for 'Name' failed on the 'required' tag")
+			},
+		},
+		"invalid_settings": {
+			config: `{"retention":{"max_versions":-1},"inmem":{}}`,
+			assert: func(t *testing.T, a archive.Archive, err error) {
+				assert.Nil(t, a)
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), "MaxVersions")
+			},
+		},
+		"invalid_namespace": {
+			config: `{"namespace":"my-resource","inmem":{}}`,
+			assert: func(t *testing.T, a archive.Archive, err error) {
+				assert.Nil(t, a)
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), "Namespace")
+			},
+		},
+		"none": {
+			config: `{"force_history":true}`,
+			assert: func(t *testing.T, a archive.Archive, err error) {
+				assert.EqualError(t, err, "no archive backend configured, expected one of: boltdb, custom, file, inmem, replicated, sql")
+			},
+		},
+		"multiple": {
+			config: `{"inmem":{},"custom":{"name":"foo"}}`,
+			assert: func(t *testing.T, a archive.Archive, err error) {
+				assert.EqualError(t, err, "multiple archive backends configured (custom, inmem), expected exactly one of: boltdb, custom, file, inmem, replicated, sql")
+			},
+		},
+		"unknown": {
+			config: `{"foo":{}}`,
+			assert: func(t *testing.T, a archive.Archive, err error) {
+				assert.EqualError(t, err, `unknown archive backend "foo", expected one of: boltdb, custom, file, inmem, replicated, sql`)
+			},
+		},
+	}
+
+	for desc, c := range cases {
+		t.Run(desc, func(t *testing.T) {
+			var cfg archive.Config
+			if !assert.NoError(t, json.Unmarshal([]byte(c.config), &cfg)) {
+				return
+			}
+			a, err := archive.New(context.Background(), cfg)
+			c.assert(t, a, err)
+		})
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	var cfg archive.Config
+	err := json.Unmarshal([]byte(`{"force_history":true,"s3":{"bucket":"foo"}}`), &cfg)
+	assert.NoError(t, err)
+	assert.True(t, cfg.ForceHistory)
+	assert.Equal(t, map[string]json.RawMessage{"s3": json.RawMessage(`{"bucket":"foo"}`)}, cfg.Backends)
+
+	b, err := json.Marshal(cfg)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"force_history":true,"incremental":false,"s3":{"bucket":"foo"}}`, string(b))
+}
+
+func TestConfigDeprecatedFields(t *testing.T) {
+	ctx := context.Background()
+	cfg := archive.Config{Inmem: &inmem.Config{History: []string{`{"id":"foo"}`}}}
+	a, err := archive.New(ctx, cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	history, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`)}, history)
+
+	b, err := json.Marshal(cfg)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"force_history":false,"incremental":false,"inmem":{"history":["{\"id\":\"foo\"}"]}}`, string(b))
+
+	cfg.Backends = map[string]json.RawMessage{"inmem": json.RawMessage(`{}`)}
+	_, err = archive.New(ctx, cfg)
+	assert.EqualError(t, err, "inmem archive backend configured via both Backends and the deprecated config field")
+}
+
+// historyOnly hides any streaming support implemented by an archive
+type historyOnly struct {
+	archive.Archive
+}
+
+func TestHistoryIter(t *testing.T) {
+	ctx := context.Background()
+	a, err := inmem.New(ctx, inmem.Config{History: []string{`{"id":"foo"}`, `{"id":"bar"}`}}, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	expected := [][]byte{[]byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`)}
+
+	for desc, a := range map[string]archive.Archive{"iterable": a, "fallback": historyOnly{a}} {
+		t.Run(desc, func(t *testing.T) {
+			var versions [][]byte
+			archive.HistoryIter(ctx, a, nil, 1)(func(v []byte, err error) bool {
+				assert.NoError(t, err)
+				versions = append(versions, v)
+				return true
+			})
+			assert.Equal(t, expected, versions)
+
+			// iteration stops when yield returns false
+			var n int
+			archive.HistoryIter(ctx, a, nil, 1)(func([]byte, error) bool {
+				n++
+				return false
+			})
+			assert.Equal(t, 1, n)
+		})
+	}
+}
+
+func TestListDelete(t *testing.T) {
+	ctx := context.Background()
+	a, err := inmem.New(ctx, inmem.Config{History: []string{`{"id":"foo"}`, `{"id":"bar"}`}}, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// archives that do not implement Lister fall back to History, with
+	// unknown archive times
+	entries, err := archive.List(ctx, historyOnly{a})
+	assert.NoError(t, err)
+	assert.Equal(t, []archive.Entry{
+		{Version: []byte(`{"id":"foo"}`)},
+		{Version: []byte(`{"id":"bar"}`)},
+	}, entries)
+
+	// archives that do not implement Deleter return an error
+	_, err = archive.Delete(ctx, historyOnly{a}, []byte(`{"id":"foo"}`))
+	assert.EqualError(t, err, "archive does not support deleting versions")
+
+	n, err := archive.Delete(ctx, a, []byte(`{"id":"foo"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	entries, err = archive.List(ctx, a)
+	assert.NoError(t, err)
+	assert.Equal(t, []archive.Entry{{Version: []byte(`{"id":"bar"}`)}}, entries)
+}
+
+func TestHas(t *testing.T) {
+	ctx := context.Background()
+	a, err := inmem.New(ctx, inmem.Config{History: []string{`{"id":"foo"}`, `{"id":"bar"}`}}, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// archives that do not implement Finder fall back to scanning History
+	for _, a := range []archive.Archive{a, historyOnly{a}} {
+		found, err := archive.Has(ctx, a, []byte(`{ "id": "bar" }`))
+		assert.NoError(t, err)
+		assert.True(t, found)
+		found, err = archive.Has(ctx, a, []byte(`{"id":"baz"}`))
+		assert.NoError(t, err)
+		assert.False(t, found)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	ctx := context.Background()
+	a, err := inmem.New(ctx, inmem.Config{}, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	meta := []archive.Metadata{{Name: "commit", Value: "abc123"}}
+	assert.NoError(t, archive.PutMetadata(ctx, a, []byte(`{"id":"foo"}`), meta))
+	archived, err := archive.GetMetadata(ctx, a, []byte(`{"id":"foo"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, meta, archived)
+
+	// archives that do not implement MetadataStore archive only the version
+	assert.NoError(t, archive.PutMetadata(ctx, historyOnly{a}, []byte(`{"id":"bar"}`), meta))
+	archived, err = archive.GetMetadata(ctx, historyOnly{a}, []byte(`{"id":"foo"}`))
+	assert.NoError(t, err)
+	assert.Nil(t, archived)
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`)}, versions)
+	archived, err = archive.GetMetadata(ctx, a, []byte(`{"id":"bar"}`))
+	assert.NoError(t, err)
+	assert.Nil(t, archived)
+}
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	cfg := file.Config{Path: filepath.Join(t.TempDir(), "archive.jsonl")}
+	a, err := file.New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close(ctx)
+	b, err := file.New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer b.Close(ctx)
+
+	lease, err := archive.Lock(ctx, a, nil)
+	if !assert.NoError(t, err) || !assert.NotNil(t, lease) {
+		return
+	}
+
+	// waiting for a lock held by another owner times out
+	_, err = archive.Lock(ctx, b, &settings.Lock{Wait: settings.Duration(300 * time.Millisecond)})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timed out after 300ms waiting for archive lock held by ")
+	}
+
+	// the lock is acquired once released by the current owner
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lease.Release(ctx)
+	}()
+	lease, err = archive.Lock(ctx, b, &settings.Lock{Wait: settings.Duration(time.Second)})
+	if assert.NoError(t, err) && assert.NotNil(t, lease) {
+		assert.NoError(t, lease.Release(ctx))
+	}
+
+	// archives that do not implement Locker, or with locking disabled, are not
+	// locked
+	lease, err = archive.Lock(ctx, historyOnly{a}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, lease)
+	lease, err = archive.Lock(ctx, a, &settings.Lock{Disabled: true})
+	assert.NoError(t, err)
+	assert.Nil(t, lease)
+}
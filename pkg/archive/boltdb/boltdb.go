@@ -1,18 +1,25 @@
 package boltdb
 
 import (
+	"bytes"
 	"context"
-	"crypto/sha1"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"path/filepath"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/boltdb/bolt"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/history"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/internal/awsutil"
 	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
 	"github.com/fatih/color"
 	"github.com/oklog/ulid/v2"
@@ -21,128 +28,440 @@ import (
 const (
 	versionsBucket = "versions"
 	indexBucket    = "versions_index"
+	metadataBucket = "versions_metadata"
+
+	dbFile = "archive.db"
+
+	defaultPageSize       = 1000
+	defaultTimeout        = 5 * time.Second
+	defaultUploadAttempts = 5
 )
 
 type (
 	// Config describes the available resource-specific configuration settings
 	Config struct {
+		// An IAM role to assume using the base credentials, which are resolved from
+		// the static credentials, profile, or default credential chain
+		AssumeRole *AssumeRole `json:"assume_role,omitempty" validate:"omitempty"`
 		// The bucket name where the boltdb database file is persisted in between builds
 		Bucket string `json:"bucket" validate:"required"`
+		// A PEM encoded CA certificate bundle used to verify the S3 endpoint, useful
+		// for internal S3-compatible stores
+		CABundle string `json:"ca_bundle"`
+		// The directory where downloaded and uploaded database files are cached,
+		// keyed by the object's ETag, so that subsequent runs in the same container
+		// skip downloading an unchanged database (default: a directory under the
+		// system temp directory)
+		CacheDir string `json:"cache_dir"`
+		// The compression applied to the database file in transit, one of: none, gzip,
+		// zstd (default: none). The algorithm is recorded in the object's metadata, so
+		// that files uploaded with different settings continue to load
+		Compression string `json:"compression" validate:"omitempty,oneof=none gzip zstd"`
 		// AWS session credentials
 		Credentials *Credentials `json:"credentials,omitempty" validate:"omitempty,dive"`
+		// The directory where the database file is created while the archive is open
+		// (default: a private temporary directory, which is removed on close)
+		Dir string `json:"dir"`
+		// Disables caching of the database file in between runs
+		DisableCache bool `json:"disable_cache"`
 		// A custom S3 endpoint, useful for testing
 		Endpoint string `json:"endpoint"`
+		// A named profile from the shared AWS config and credentials files
+		Profile string `json:"profile" validate:"excluded_with=Credentials WebIdentity"`
 		// The AWS region where the bucket was created
 		Region string `json:"region" validate:"required"`
 		// The fully qualified S3 object key used for persisting the database file in
-		// between builds
+		// between builds, which can be shared by many resources that configure
+		// distinct namespaces
 		Key string `json:"key" validate:"required"`
+		// Server-side encryption applied to the database file
+		ServerSideEncryption *ServerSideEncryption `json:"server_side_encryption,omitempty" validate:"omitempty"`
+		// The S3 storage class of the database file (default: STANDARD)
+		StorageClass string `json:"storage_class" validate:"omitempty,oneof=STANDARD REDUCED_REDUNDANCY STANDARD_IA ONEZONE_IA INTELLIGENT_TIERING GLACIER_IR"`
+		// Tags applied to the database file
+		Tags map[string]string `json:"tags"`
+		// The maximum amount of time to wait to obtain a lock on the database file,
+		// which may be held by a stale process (default: 5s)
+		Timeout settings.Duration `json:"timeout" validate:"min=0"`
+		// The maximum number of attempts to upload the database file when it is
+		// modified concurrently by another build (default: 5)
+		UploadAttempts int `json:"upload_attempts" validate:"omitempty,min=1"`
+		// An IAM role to assume using an OIDC web identity token, which cannot be
+		// combined with other credential settings
+		WebIdentity *WebIdentity `json:"web_identity,omitempty" validate:"omitempty"`
 	}
 
+	// AssumeRole describes an IAM role assumed using the base credentials
+	AssumeRole = awsutil.AssumeRole
+
 	// Credentials describes AWS session credentials used for authenticating with S3
-	Credentials struct {
-		// The AWS_ACCESS_KEY_ID value to use for authenticating with S3
-		AccessKey string `json:"access_key" validate:"required"`
-		// The AWS_SECRET_ACCESS_KEY value to use for authenticating with S3
-		SecretKey string `json:"secret_key" validate:"required"`
-		// The AWS_SESSION_TOKEN value to use for authenticating with S3
-		SessionToken string `json:"session_token"`
+	Credentials = awsutil.Credentials
+
+	// ServerSideEncryption describes the server-side encryption applied to the
+	// database file
+	ServerSideEncryption struct {
+		// The server-side encryption algorithm, one of: AES256 (SSE-S3), aws:kms
+		// (SSE-KMS)
+		Algorithm string `json:"algorithm" validate:"required,oneof=AES256 aws:kms"`
+		// The ID, ARN, or alias of the KMS key used with aws:kms (default: the
+		// AWS managed key)
+		KMSKeyID string `json:"kms_key_id"`
 	}
+
+	// WebIdentity describes an IAM role assumed using an OIDC web identity token
+	WebIdentity = awsutil.WebIdentity
 )
 
 // Archive implements a resource version archive using BoltDB backed by AWS S3.
 type Archive struct {
 	cfg      *Config
 	db       *bolt.DB
+	deleted  [][]byte
+	dirty    bool
+	etag     *string
+	lease    *awsutil.Lease
+	metadata map[[canonical.Size]byte][]byte
+	path     string
+	pending  [][]byte
 	s3       *s3.Client
 	settings *settings.Settings
-	stats    bolt.BucketStats
+	tmp      string
 }
 
 func New(ctx context.Context, cfg Config, s *settings.Settings) (*Archive, error) {
-	a := &Archive{cfg: &cfg, settings: s}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = settings.Duration(defaultTimeout)
+	}
+	if cfg.UploadAttempts <= 0 {
+		cfg.UploadAttempts = defaultUploadAttempts
+	}
+	a := &Archive{cfg: &cfg, metadata: make(map[[canonical.Size]byte][]byte), settings: s}
+	if err := a.initDir(); err != nil {
+		return nil, err
+	}
 	if err := a.initS3(ctx); err != nil {
+		a.cleanup()
 		return nil, err
 	}
 
 	file, err := a.downloadDB(ctx)
 	if err != nil {
+		a.cleanup()
 		return nil, err
 	}
 
 	if err := a.initDB(ctx, file); err != nil {
+		a.cleanup()
 		return nil, err
 	}
 
 	return a, nil
 }
 
-func (a *Archive) Close(ctx context.Context) error {
-	var finalStats *bolt.BucketStats
-	err := a.db.View(func(tx *bolt.Tx) error {
-		stats := tx.Bucket([]byte(versionsBucket)).Stats()
-		finalStats = &stats
-		return nil
-	})
-	if err != nil {
-		color.Red("error retrieving final bucket statistics")
+// validate checks constraints spanning multiple fields that are not
+// expressible using struct tags
+func (c *Config) validate() error {
+	if c.WebIdentity != nil && (c.AssumeRole != nil || c.Credentials != nil) {
+		return errors.New("web_identity cannot be combined with assume_role or credentials")
+	}
+	if sse := c.ServerSideEncryption; sse != nil && sse.KMSKeyID != "" && sse.Algorithm != string(types.ServerSideEncryptionAwsKms) {
+		return errors.New("server_side_encryption.kms_key_id requires algorithm aws:kms")
 	}
+	return nil
+}
 
+func (a *Archive) Close(ctx context.Context) error {
+	defer a.cleanup()
 	if err := a.db.Close(); err != nil {
 		return fmt.Errorf("error closing database: %v", err)
 	}
-	if finalStats != nil && a.stats.KeyN == finalStats.KeyN {
+	if !a.dirty {
 		return nil
 	}
 
-	f, err := os.Open("archive.db")
+	for attempt := 1; ; attempt++ {
+		// never upload changes made while holding a lease that was stolen, as
+		// the new holder may be modifying the database
+		if a.lease != nil {
+			if err := a.lease.Held(ctx); err != nil {
+				return fmt.Errorf("error uploading database: %v", err)
+			}
+		}
+
+		err := a.uploadDB(ctx)
+		if err == nil || !awsutil.IsConflict(err) || attempt >= a.cfg.UploadAttempts {
+			return err
+		}
+
+		color.Yellow("archive modified by another build, merging versions and retrying upload (attempt %d of %d)...", attempt+1, a.cfg.UploadAttempts)
+		if err := a.merge(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *Archive) History(ctx context.Context, latest []byte) ([][]byte, error) {
+	return history.Collect(a.HistoryIter(ctx, latest, 0))
+}
+
+// HistoryIter returns an iterator over the versions returned by History,
+// reading at most pageSize versions per read transaction (default: 1000)
+func (a *Archive) HistoryIter(ctx context.Context, latest []byte, pageSize int) history.Seq {
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	return func(yield func([]byte, error) bool) {
+		since, ok := history.Since(latest, a.settings)
+		if !ok {
+			return
+		}
+		var cursor []byte
+		if since != nil {
+			id, err := a.id(since)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if id == nil {
+				return
+			}
+			cursor = id
+		}
+
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			page, next, err := a.page(cursor, pageSize)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _, version := range page {
+				if !yield(version, nil) {
+					return
+				}
+			}
+			if next == nil {
+				return
+			}
+			cursor = next
+		}
+	}
+}
+
+// id returns the id of the given version, located via the versions index,
+// or nil if the version has not been archived
+func (a *Archive) id(version []byte) (id []byte, err error) {
+	sum, err := canonical.Hash(version)
 	if err != nil {
-		return fmt.Errorf("error opening database file for upload: %v", err)
+		return nil, fmt.Errorf("error hashing latest version: %v", err)
 	}
-	defer f.Close()
 
-	_, err = a.s3.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &a.cfg.Bucket,
-		Key:    &a.cfg.Key,
-		Body:   f,
+	err = a.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(a.bucket(indexBucket))
+		if index == nil {
+			return fmt.Errorf("database missing %s bucket", indexBucket)
+		}
+		id = bytes.Clone(index.Get(sum[:]))
+		return nil
 	})
-	return err
+	return id, err
 }
 
-func (a *Archive) History(ctx context.Context, latest []byte) (history [][]byte, err error) {
-	// exit early if concourse has version history
-	if latest != nil && !a.settings.ForceHistory {
-		return nil, nil
-	}
+// Has returns true if the given version has been archived
+func (a *Archive) Has(ctx context.Context, version []byte) (bool, error) {
+	id, err := a.id(version)
+	return id != nil, err
+}
 
+// page reads up to n versions with ids greater than the given cursor, or
+// from the beginning if cursor is nil, returning the id of the last version
+// read if additional versions may remain
+func (a *Archive) page(cursor []byte, n int) (page [][]byte, last []byte, err error) {
 	err = a.db.View(func(tx *bolt.Tx) error {
-		versions := tx.Bucket([]byte(versionsBucket))
+		versions := tx.Bucket(a.bucket(versionsBucket))
 		if versions == nil {
 			return fmt.Errorf("database missing %s bucket", versionsBucket)
 		}
 
-		return versions.ForEach(func(_, v []byte) error {
-			history = append(history, v)
+		c := versions.Cursor()
+		k, v := c.First()
+		if cursor != nil {
+			if k, v = c.Seek(cursor); bytes.Equal(k, cursor) {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil; k, v = c.Next() {
+			page = append(page, bytes.Clone(v))
+			if len(page) == n {
+				last = bytes.Clone(k)
+				break
+			}
+		}
+		return nil
+	})
+	return page, last, err
+}
+
+func (a *Archive) Put(ctx context.Context, next ...[]byte) error {
+	if err := a.put(next...); err != nil {
+		return err
+	}
+	a.pending = append(a.pending, next...)
+	return nil
+}
+
+// PutMetadata archives a version along with its metadata, which is stored in
+// a separate bucket keyed by canonical version hash and re-applied when
+// merging concurrent modifications prior to upload
+func (a *Archive) PutMetadata(ctx context.Context, version []byte, metadata []history.Metadata) error {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return fmt.Errorf("error hashing version: %v", err)
+	}
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("error serializing metadata: %v", err)
+	}
+	if err := a.putMetadata(map[[canonical.Size]byte][]byte{sum: b}); err != nil {
+		return err
+	}
+	a.metadata[sum] = b
+	return a.Put(ctx, version)
+}
+
+// Metadata returns the metadata archived alongside the given version
+func (a *Archive) Metadata(ctx context.Context, version []byte) (metadata []history.Metadata, err error) {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing version: %v", err)
+	}
+	err = a.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(a.bucket(metadataBucket))
+		if bucket == nil {
+			return nil
+		}
+		raw := bucket.Get(sum[:])
+		if raw == nil {
+			return nil
+		}
+		if err := json.Unmarshal(raw, &metadata); err != nil {
+			return fmt.Errorf("error parsing metadata: %v", err)
+		}
+		return nil
+	})
+	return metadata, err
+}
+
+// putMetadata persists serialized metadata keyed by canonical version hash
+func (a *Archive) putMetadata(entries map[[canonical.Size]byte][]byte) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return a.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(a.bucket(metadataBucket))
+		if err != nil {
+			return fmt.Errorf("error creating %s bucket: %v", metadataBucket, err)
+		}
+		for sum, b := range entries {
+			if err := bucket.Put(bytes.Clone(sum[:]), b); err != nil {
+				return fmt.Errorf("error updating metadata: %v", err)
+			}
+		}
+		a.dirty = true
+		return nil
+	})
+}
+
+// List returns all versions along with the time each was archived, using the
+// timestamp embedded in each version id
+func (a *Archive) List(ctx context.Context) (entries []history.Entry, err error) {
+	err = a.db.View(func(tx *bolt.Tx) error {
+		versions := tx.Bucket(a.bucket(versionsBucket))
+		if versions == nil {
+			return fmt.Errorf("database missing %s bucket", versionsBucket)
+		}
+		return versions.ForEach(func(k, v []byte) error {
+			var id ulid.ULID
+			if err := id.UnmarshalBinary(k); err != nil {
+				return fmt.Errorf("error parsing version id: %v", err)
+			}
+			entries = append(entries, history.Entry{Archived: ulid.Time(id.Time()), Version: bytes.Clone(v)})
 			return nil
 		})
 	})
-	return history, err
+	return entries, err
 }
 
-func (a *Archive) Put(ctx context.Context, next ...[]byte) error {
+// Delete removes the given versions, which are removed again when merging
+// concurrent modifications prior to upload
+func (a *Archive) Delete(ctx context.Context, versions ...[]byte) (int, error) {
+	n, err := a.remove(versions...)
+	if err != nil {
+		return 0, err
+	}
+	a.deleted = append(a.deleted, versions...)
+	return n, nil
+}
+
+// remove deletes the given versions from the database, returning the number
+// of versions removed
+func (a *Archive) remove(targets ...[]byte) (n int, err error) {
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		versions, index := tx.Bucket(a.bucket(versionsBucket)), tx.Bucket(a.bucket(indexBucket))
+		if versions == nil || index == nil {
+			return fmt.Errorf("database missing %s or %s bucket", versionsBucket, indexBucket)
+		}
+		for _, version := range targets {
+			sum, err := canonical.Hash(version)
+			if err != nil {
+				return fmt.Errorf("error hashing version: %v", err)
+			}
+			id := index.Get(sum[:])
+			if id == nil {
+				continue
+			}
+			if err := versions.Delete(bytes.Clone(id)); err != nil {
+				return fmt.Errorf("error deleting version: %v", err)
+			}
+			if err := index.Delete(sum[:]); err != nil {
+				return fmt.Errorf("error updating index: %v", err)
+			}
+			if err := a.deleteMetadata(tx, sum); err != nil {
+				return err
+			}
+			a.dirty = true
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// put appends new versions to the local database and prunes old versions
+// according to the configured retention policy
+func (a *Archive) put(next ...[]byte) error {
 	return a.db.Update(func(tx *bolt.Tx) error {
-		versions, err := tx.CreateBucketIfNotExists([]byte(versionsBucket))
+		versions, err := tx.CreateBucketIfNotExists(a.bucket(versionsBucket))
 		if err != nil {
 			return fmt.Errorf("error creating versions bucket: %v", err)
 		}
 
-		index, err := tx.CreateBucketIfNotExists([]byte(indexBucket))
+		index, err := tx.CreateBucketIfNotExists(a.bucket(indexBucket))
 		if err != nil {
 			return fmt.Errorf("error creating versions_index bucket: %v", err)
 		}
 
 		for _, version := range next {
-			sum := sha1.Sum(version)
+			sum, err := canonical.Hash(version)
+			if err != nil {
+				return fmt.Errorf("error hashing version: %v", err)
+			}
 			if value := index.Get(sum[:]); value == nil {
 				id := ulid.Make().Bytes()
 				if err := index.Put(sum[:], id); err != nil {
@@ -152,58 +471,266 @@ func (a *Archive) Put(ctx context.Context, next ...[]byte) error {
 				if err := versions.Put(id, version); err != nil {
 					return fmt.Errorf("error updating versions: %v", err)
 				}
+				a.dirty = true
 			}
 		}
+		return a.prune(tx, versions, index)
+	})
+}
+
+// prune removes the oldest versions according to the configured retention
+// policy, using the timestamp embedded in each version's ulid key
+func (a *Archive) prune(tx *bolt.Tx, versions, index *bolt.Bucket) error {
+	retention := a.settings.Retention
+	if retention == nil {
+		return nil
+	}
+
+	var ids [][]byte
+	var archived []time.Time
+	err := versions.ForEach(func(k, _ []byte) error {
+		var id ulid.ULID
+		if err := id.UnmarshalBinary(k); err != nil {
+			return fmt.Errorf("error parsing version id: %v", err)
+		}
+		ids = append(ids, bytes.Clone(k))
+		archived = append(archived, ulid.Time(id.Time()))
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	n := retention.Prune(time.Now(), archived)
+	if n == 0 {
+		return nil
+	}
+	if retention.DryRun {
+		pruned := make([][]byte, 0, n)
+		for _, id := range ids[:n] {
+			pruned = append(pruned, versions.Get(id))
+		}
+		retention.Report(pruned)
+		return nil
+	}
+
+	for _, id := range ids[:n] {
+		sum, err := canonical.Hash(versions.Get(id))
+		if err != nil {
+			return fmt.Errorf("error hashing version: %v", err)
+		}
+		if err := index.Delete(sum[:]); err != nil {
+			return fmt.Errorf("error updating index: %v", err)
+		}
+		if err := a.deleteMetadata(tx, sum); err != nil {
+			return err
+		}
+		if err := versions.Delete(id); err != nil {
+			return fmt.Errorf("error pruning version: %v", err)
+		}
+	}
+	a.dirty = true
+	return nil
+}
+
+// deleteMetadata removes the metadata archived alongside the version with the
+// given hash, if any
+func (a *Archive) deleteMetadata(tx *bolt.Tx, sum [canonical.Size]byte) error {
+	bucket := tx.Bucket(a.bucket(metadataBucket))
+	if bucket == nil {
+		return nil
+	}
+	if err := bucket.Delete(sum[:]); err != nil {
+		return fmt.Errorf("error deleting metadata: %v", err)
+	}
+	return nil
 }
 
 // downloadDB downloads a boltdb file from s3
 func (a *Archive) downloadDB(ctx context.Context) (string, error) {
+	cached, etag := a.cached()
 	resp, err := a.s3.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &a.cfg.Bucket,
-		Key:    &a.cfg.Key,
+		Bucket:      &a.cfg.Bucket,
+		Key:         &a.cfg.Key,
+		IfNoneMatch: etag,
 	})
 	if err != nil {
+		if etag != nil && isNotModified(err) {
+			a.etag = etag
+			return a.restore(cached)
+		}
 		var notFound *types.NoSuchKey
 		if errors.As(err, &notFound) {
-			return "archive.db", nil
+			a.etag = nil
+			if err := os.Remove(a.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return "", fmt.Errorf("error removing stale database: %v", err)
+			}
+			return a.path, nil
 		}
 		return "", fmt.Errorf("error downloading database: %v", err)
 	}
 	defer resp.Body.Close()
+	a.etag = resp.ETag
+
+	var body io.Reader = resp.Body
+	if algorithm := resp.Metadata[compressionMetadataKey]; algorithm != "" && algorithm != compressionNone {
+		r, err := decompress(resp.Body, algorithm)
+		if err != nil {
+			return "", fmt.Errorf("error decompressing database: %v", err)
+		}
+		defer r.Close()
+		body = r
+	}
 
-	db, err := os.Create("archive.db")
+	db, err := os.OpenFile(a.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
-		return "", fmt.Errorf("error creating archive.db: %v", err)
+		return "", fmt.Errorf("error creating database file: %v", err)
 	}
 	defer db.Close()
 
-	if _, err := io.Copy(db, resp.Body); err != nil {
-		return "", fmt.Errorf("error writing archive.db: %v", err)
+	if _, err := io.Copy(db, body); err != nil {
+		return "", fmt.Errorf("error writing database file: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		return "", fmt.Errorf("error writing database file: %v", err)
 	}
+	a.store(a.etag)
 	return db.Name(), nil
 }
 
+// putObjectInput returns the PutObject input used to upload the database
+// file, with the configured encryption, storage class, and tags applied
+func (a *Archive) putObjectInput() *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket: &a.cfg.Bucket,
+		Key:    &a.cfg.Key,
+	}
+	if sse := a.cfg.ServerSideEncryption; sse != nil {
+		input.ServerSideEncryption = types.ServerSideEncryption(sse.Algorithm)
+		if sse.KMSKeyID != "" {
+			input.SSEKMSKeyId = &sse.KMSKeyID
+		}
+	}
+	if a.cfg.StorageClass != "" {
+		input.StorageClass = types.StorageClass(a.cfg.StorageClass)
+	}
+	if len(a.cfg.Tags) > 0 {
+		tags := make(url.Values, len(a.cfg.Tags))
+		for k, v := range a.cfg.Tags {
+			tags.Set(k, v)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+	return input
+}
+
+// uploadDB compacts and optionally compresses the local boltdb file, and
+// uploads it to s3, conditional on the remote object being unmodified since
+// it was downloaded
+func (a *Archive) uploadDB(ctx context.Context) error {
+	if err := compact(a.path, time.Duration(a.cfg.Timeout)); err != nil {
+		return err
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return fmt.Errorf("error opening database file for upload: %v", err)
+	}
+	defer f.Close()
+
+	algorithm := a.cfg.Compression
+	if algorithm == "" {
+		algorithm = compressionNone
+	}
+	input := a.putObjectInput()
+	input.Body = f
+	input.Metadata = map[string]string{compressionMetadataKey: algorithm}
+	if algorithm != compressionNone {
+		compressed, err := compressFile(f, algorithm)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			compressed.Close()
+			os.Remove(compressed.Name())
+		}()
+		input.Body = compressed
+	}
+
+	condition := smithyhttp.SetHeaderValue("If-None-Match", "*")
+	if a.etag != nil {
+		condition = smithyhttp.SetHeaderValue("If-Match", *a.etag)
+	}
+
+	resp, err := a.s3.PutObject(ctx, input, s3.WithAPIOptions(condition))
+	if err != nil {
+		return err
+	}
+	a.store(resp.ETag)
+	return nil
+}
+
+// merge downloads the latest remote database and appends all versions put
+// during the lifetime of this archive
+func (a *Archive) merge(ctx context.Context) error {
+	if err := a.reload(ctx); err != nil {
+		return err
+	}
+	if err := a.db.Close(); err != nil {
+		return fmt.Errorf("error closing database: %v", err)
+	}
+	return nil
+}
+
+// reload replaces the closed local database with the latest remote database,
+// and re-applies all changes made during the lifetime of this archive
+func (a *Archive) reload(ctx context.Context) error {
+	if err := os.Remove(a.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing stale database: %v", err)
+	}
+
+	file, err := a.downloadDB(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := a.initDB(ctx, file); err != nil {
+		return err
+	}
+
+	if err := a.putMetadata(a.metadata); err != nil {
+		a.db.Close()
+		return fmt.Errorf("error merging metadata: %v", err)
+	}
+	if err := a.put(a.pending...); err != nil {
+		a.db.Close()
+		return fmt.Errorf("error merging versions: %v", err)
+	}
+	if _, err := a.remove(a.deleted...); err != nil {
+		a.db.Close()
+		return fmt.Errorf("error merging deleted versions: %v", err)
+	}
+	return nil
+}
+
 // initDB initializes a bolt database
 func (a *Archive) initDB(ctx context.Context, file string) error {
-	db, err := bolt.Open(file, 0600, nil)
+	db, err := openDB(file, time.Duration(a.cfg.Timeout), false)
 	if err != nil {
 		return fmt.Errorf("error opening database: %v", err)
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		versions, err := tx.CreateBucketIfNotExists([]byte(versionsBucket))
+		versions, err := tx.CreateBucketIfNotExists(a.bucket(versionsBucket))
 		if err != nil {
 			return fmt.Errorf("error creating versions bucket: %v", err)
 		}
-		a.stats = versions.Stats()
 
-		_, err = tx.CreateBucketIfNotExists([]byte(indexBucket))
+		index, err := tx.CreateBucketIfNotExists(a.bucket(indexBucket))
 		if err != nil {
 			return fmt.Errorf("error creating versions_index bucket: %v", err)
 		}
-		return nil
+		return a.reindex(tx, versions, index)
 	})
 	if err != nil {
 		return fmt.Errorf("error initializing database: %v", err)
@@ -213,33 +740,106 @@ func (a *Archive) initDB(ctx context.Context, file string) error {
 	return nil
 }
 
-// initS3 initializes an s3 client
-func (a *Archive) initS3(ctx context.Context) error {
-	if a.s3 != nil {
+// reindex rebuilds the versions index using canonical version hashes if the
+// index contains entries created by a legacy hashing strategy
+func (a *Archive) reindex(tx *bolt.Tx, versions, index *bolt.Bucket) error {
+	var legacy bool
+	err := index.ForEach(func(k, _ []byte) error {
+		if len(k) != canonical.Size {
+			legacy = true
+		}
 		return nil
+	})
+	if err != nil || !legacy {
+		return err
 	}
 
-	opts := []func(*config.LoadOptions) error{
-		config.WithRegion(a.cfg.Region),
+	color.Yellow("rebuilding archive index...")
+	if err := tx.DeleteBucket(a.bucket(indexBucket)); err != nil {
+		return fmt.Errorf("error deleting legacy versions_index bucket: %v", err)
 	}
-	if creds := a.cfg.Credentials; creds != nil {
-		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(creds.AccessKey, creds.SecretKey, creds.SessionToken)))
+	index, err = tx.CreateBucket(a.bucket(indexBucket))
+	if err != nil {
+		return fmt.Errorf("error creating versions_index bucket: %v", err)
 	}
+	// upload the rebuilt index on close, even if no versions are archived
+	a.dirty = true
+	return versions.ForEach(func(id, v []byte) error {
+		sum, err := canonical.Hash(v)
+		if err != nil {
+			return fmt.Errorf("error hashing version %s: %v", id, err)
+		}
+		if index.Get(sum[:]) != nil {
+			return nil
+		}
+		return index.Put(sum[:], bytes.Clone(id))
+	})
+}
 
-	sess, err := config.LoadDefaultConfig(ctx, opts...)
-	if err != nil {
-		return fmt.Errorf("error initializing aws session: %v", err)
+// bucket returns the name of the given bucket within the configured
+// namespace, allowing the versions of many resources to share a database
+func (a *Archive) bucket(name string) []byte {
+	if a.settings.Namespace == "" {
+		return []byte(name)
+	}
+	return []byte(name + "/" + a.settings.Namespace)
+}
+
+// openDB opens the database file at path, failing with a descriptive error if
+// the file lock cannot be obtained within the timeout
+func openDB(path string, timeout time.Duration, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: readOnly, Timeout: timeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("timed out after %s waiting for lock on %s, which may be held by another process", timeout, path)
+	}
+	return db, err
+}
+
+// initDir initializes the directory containing the local database file,
+// creating a private temporary directory if none is configured
+func (a *Archive) initDir() error {
+	dir := a.cfg.Dir
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "concourse-archive-*")
+		if err != nil {
+			return fmt.Errorf("error creating database directory: %v", err)
+		}
+		dir, a.tmp = tmp, tmp
+	} else if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error creating database directory: %v", err)
+	}
+	a.path = filepath.Join(dir, dbFile)
+	return nil
+}
+
+// cleanup removes the local database file, along with its directory if it
+// was created by the archive
+func (a *Archive) cleanup() {
+	if a.tmp != "" {
+		os.RemoveAll(a.tmp)
+		return
 	}
+	os.Remove(a.path)
+}
 
-	var s3opts []func(*s3.Options)
-	if a.cfg.Endpoint != "" {
-		s3opts = append(s3opts,
-			s3.WithEndpointResolver(s3.EndpointResolverFromURL(a.cfg.Endpoint)),
-			func(o *s3.Options) {
-				o.UsePathStyle = true
-			},
-		)
+// initS3 initializes an s3 client
+func (a *Archive) initS3(ctx context.Context) error {
+	if a.s3 != nil {
+		return nil
+	}
+
+	client, err := awsutil.NewS3Client(ctx, awsutil.Config{
+		AssumeRole:  a.cfg.AssumeRole,
+		CABundle:    a.cfg.CABundle,
+		Credentials: a.cfg.Credentials,
+		Endpoint:    a.cfg.Endpoint,
+		Profile:     a.cfg.Profile,
+		Region:      a.cfg.Region,
+		WebIdentity: a.cfg.WebIdentity,
+	})
+	if err != nil {
+		return err
 	}
-	a.s3 = s3.NewFromConfig(sess, s3opts...)
+	a.s3 = client
 	return nil
 }
@@ -1,17 +1,30 @@
 package boltdb
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha1"
 	"fmt"
+	"io"
 	"math/big"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/boltdb/bolt"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/history"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/internal/archivetest"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/lock"
 	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/go-playground/validator/v10"
+	"github.com/oklog/ulid/v2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -20,16 +33,135 @@ func TestArchive(t *testing.T) {
 		t.Skip()
 	}
 
-	dir := t.TempDir()
-	err := os.Chdir(dir)
+	archivetest.Run(t, func(t *testing.T) archivetest.Opener {
+		ctx := context.Background()
+		cfg := setup(t, ctx)
+		return func(s *settings.Settings) (archivetest.Archive, error) {
+			return New(ctx, cfg, s)
+		}
+	})
+}
+
+func TestArchiveConcurrentUpload(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	ctx := context.Background()
+	cfg := setup(t, ctx)
+
+	// seed archive
+	a, err := New(ctx, cfg, &settings.Settings{})
 	if !assert.NoError(t, err) {
 		return
 	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"foo"}`)))
+	if !assert.NoError(t, a.Close(ctx)) {
+		return
+	}
 
-	id, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	// open archive and add a new version
+	a, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"bar"}`)))
+
+	// concurrently open archive and add a different version
+	b, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, b.Put(ctx, []byte(`{"id":"baz"}`)))
+	assert.NoError(t, b.Close(ctx))
+
+	// close original archive, which should detect the conflict and merge
+	if !assert.NoError(t, a.Close(ctx)) {
+		return
+	}
+
+	a, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, a.Close(ctx))
+	}()
+
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"id":"foo"}`),
+		[]byte(`{"id":"baz"}`),
+		[]byte(`{"id":"bar"}`),
+	}, versions)
+}
+
+func TestArchiveRetention(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	ctx := context.Background()
+	cfg := setup(t, ctx)
+	retention := &settings.Retention{DryRun: true, MaxVersions: 3}
+
+	// dry run should not prune any versions
+	a, err := New(ctx, cfg, &settings.Settings{Retention: retention})
 	if !assert.NoError(t, err) {
 		return
 	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"a"}`), []byte(`{"id":"b"}`), []byte(`{"id":"c"}`), []byte(`{"id":"d"}`)))
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 4)
+	if !assert.NoError(t, a.Close(ctx)) {
+		return
+	}
+
+	// versions should be pruned and persisted even when the total number of
+	// versions is unchanged
+	retention.DryRun = false
+	for _, next := range []string{`{"id":"e"}`, `{"id":"f"}`} {
+		a, err = New(ctx, cfg, &settings.Settings{Retention: retention})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, a.Put(ctx, []byte(next)))
+		if !assert.NoError(t, a.Close(ctx)) {
+			return
+		}
+	}
+
+	a, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, a.Close(ctx))
+	}()
+	versions, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"id":"d"}`),
+		[]byte(`{"id":"e"}`),
+		[]byte(`{"id":"f"}`),
+	}, versions)
+
+	// pruned versions are removed from the index
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"a"}`)))
+	versions, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 4)
+}
+
+// setup creates a test bucket that is removed when the test completes, and
+// returns a valid archive config
+func setup(t *testing.T, ctx context.Context) Config {
+	id, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		t.Fatalf("error generating bucket id: %v", err)
+	}
 
 	cfg := Config{
 		Bucket:   fmt.Sprintf("test-%s", id.String()),
@@ -42,15 +174,13 @@ func TestArchive(t *testing.T) {
 		},
 	}
 
-	ctx := context.Background()
-
 	// initialize test s3 client
 	sess, err := config.LoadDefaultConfig(ctx,
 		config.WithRegion(cfg.Region),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfg.Credentials.AccessKey, cfg.Credentials.SecretKey, cfg.Credentials.SessionToken)),
 	)
-	if !assert.NoError(t, err) {
-		return
+	if err != nil {
+		t.Fatalf("error initializing aws session: %v", err)
 	}
 	s3client := s3.NewFromConfig(sess,
 		s3.WithEndpointResolver(s3.EndpointResolverFromURL(cfg.Endpoint)),
@@ -65,8 +195,8 @@ func TestArchive(t *testing.T) {
 	}); err != nil {
 		t.Fatalf("error creating s3 bucket: %v", err)
 	}
-	defer func() {
-		_, err = s3client.DeleteObject(ctx, &s3.DeleteObjectInput{
+	t.Cleanup(func() {
+		_, err := s3client.DeleteObject(ctx, &s3.DeleteObjectInput{
 			Bucket: &cfg.Bucket,
 			Key:    &cfg.Key,
 		})
@@ -75,89 +205,539 @@ func TestArchive(t *testing.T) {
 			Bucket: &cfg.Bucket,
 		})
 		assert.NoError(t, err)
-	}()
+	})
+	return cfg
+}
+
+func TestArchiveCompression(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	ctx := context.Background()
+	cfg := setup(t, ctx)
+
+	// each upload uses a different compression setting, and should load the
+	// file persisted by the previous upload regardless of its compression
+	var expected [][]byte
+	for i, compression := range []string{"", "zstd", "gzip", "none"} {
+		cfg.Compression = compression
+		a, err := New(ctx, cfg, &settings.Settings{})
+		if !assert.NoError(t, err, compression) {
+			return
+		}
+		versions, err := a.History(ctx, nil)
+		assert.NoError(t, err, compression)
+		assert.Equal(t, expected, versions, compression)
+
+		version := []byte(fmt.Sprintf(`{"id":"%d"}`, i))
+		assert.NoError(t, a.Put(ctx, version))
+		expected = append(expected, version)
+		if !assert.NoError(t, a.Close(ctx), compression) {
+			return
+		}
+
+		resp, err := a.s3.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: &cfg.Bucket,
+			Key:    &cfg.Key,
+		})
+		if !assert.NoError(t, err, compression) {
+			return
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err)
+
+		switch compression {
+		case compressionGzip:
+			assert.Equal(t, compressionGzip, resp.Metadata[compressionMetadataKey])
+			assert.Equal(t, []byte{0x1f, 0x8b}, b[:2])
+		case compressionZstd:
+			assert.Equal(t, compressionZstd, resp.Metadata[compressionMetadataKey])
+			assert.Equal(t, []byte{0x28, 0xb5, 0x2f, 0xfd}, b[:4])
+		default:
+			assert.Equal(t, compressionNone, resp.Metadata[compressionMetadataKey])
+		}
+	}
+}
+
+func TestArchiveCache(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	ctx := context.Background()
+	cfg := setup(t, ctx)
+	cfg.CacheDir = t.TempDir()
 
 	a, err := New(ctx, cfg, &settings.Settings{})
 	if !assert.NoError(t, err) {
 		return
 	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"foo"}`)))
+	if !assert.NoError(t, a.Close(ctx)) {
+		return
+	}
+
+	// the uploaded database should be cached under the object's current etag
+	path, etag := a.cached()
+	if !assert.NotNil(t, etag) {
+		return
+	}
+	head, err := a.s3.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &cfg.Bucket, Key: &cfg.Key})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, *head.ETag, *etag)
 
-	history, err := a.History(ctx, nil)
+	// modify the cached copy directly, which should be restored rather than
+	// downloading the unchanged object
+	db, err := bolt.Open(path, 0600, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(versionsBucket)).Put(ulid.Make().Bytes(), []byte(`{"id":"cached"}`))
+	}))
+	assert.NoError(t, db.Close())
+
+	a, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	versions, err := a.History(ctx, nil)
 	assert.NoError(t, err)
-	assert.Len(t, history, 0)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`), []byte(`{"id":"cached"}`)}, versions)
+	assert.NoError(t, a.Close(ctx))
 
-	history = [][]byte{
-		[]byte(`{"id":"foo"}`),
-		[]byte(`{"id":"bar"}`),
-		[]byte(`{"id":"baz"}`),
+	// modify the object without updating the cache, which should invalidate
+	// the cached copy
+	uncached := cfg
+	uncached.DisableCache = true
+	b, err := New(ctx, uncached, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, b.Put(ctx, []byte(`{"id":"bar"}`)))
+	if !assert.NoError(t, b.Close(ctx)) {
+		return
 	}
 
-	// load history
-	err = a.Put(ctx, history...)
+	a, err = New(ctx, cfg, &settings.Settings{})
 	if !assert.NoError(t, err) {
-		t.FailNow()
+		return
 	}
+	defer func() {
+		assert.NoError(t, a.Close(ctx))
+	}()
+	versions, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`)}, versions)
+}
+
+func TestArchiveLock(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	ctx := context.Background()
+	cfg := setup(t, ctx)
 
-	// retrieve and compare version order with latest version, no force history
-	versions, err := a.History(ctx, []byte(`{"id":"baz"}`))
+	// open an archive before the lock is held by another step
+	a, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := New(ctx, cfg, &settings.Settings{Namespace: "other"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	lease, err := b.TryLock(ctx, lock.Request{Owner: "foo", TTL: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the lock is shared by every namespace within the database object
+	_, err = a.TryLock(ctx, lock.Request{Owner: "bar", Steal: true, TTL: time.Minute})
+	var held *lock.HeldError
+	if assert.ErrorAs(t, err, &held) {
+		assert.Equal(t, "foo", held.Owner)
+	}
+
+	// versions archived by the holder are included once the lock is acquired
+	c, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, c.Put(ctx, []byte(`{"id":"foo"}`)))
+	assert.NoError(t, c.Close(ctx))
+	assert.NoError(t, b.Close(ctx))
+	assert.NoError(t, lease.Release(ctx))
+
+	lease, err = a.TryLock(ctx, lock.Request{Owner: "bar", TTL: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+	versions, err := a.History(ctx, nil)
 	assert.NoError(t, err)
-	assert.Len(t, versions, 0)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`)}, versions)
+
+	// the reloaded database is uploaded without merging
+	head, err := a.s3.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &cfg.Bucket, Key: &cfg.Key})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, *head.ETag, *a.etag)
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"bar"}`)))
+	assert.NoError(t, a.Close(ctx))
+	assert.NoError(t, lease.Release(ctx))
 
-	// retrieve and compare version order with no latest version
+	a, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
 	versions, err = a.History(ctx, nil)
 	assert.NoError(t, err)
-	assert.Equal(t, history, versions)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`)}, versions)
+	assert.NoError(t, a.Close(ctx))
 
-	// retrieve and compare version order with latest version, no force history
-	a.settings.ForceHistory = true
-	forcedHistory, err := a.History(ctx, []byte(`{"id":"baz"}`))
-	assert.NoError(t, err)
-	assert.Equal(t, history, forcedHistory)
+	// changes made while holding a lease that expired and was stolen are
+	// never uploaded
+	a, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	lease, err = a.TryLock(ctx, lock.Request{Owner: "foo", TTL: -time.Second})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"baz"}`)))
+	b, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer b.Close(ctx)
+	stolen, err := b.TryLock(ctx, lock.Request{Owner: "bar", Steal: true, TTL: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if err := a.Close(ctx); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "archive lock no longer held: lease expired and was stolen by bar")
+	}
+	assert.Error(t, lease.Release(ctx))
+	assert.NoError(t, stolen.Release(ctx))
 
-	// close archive
-	err = a.Close(ctx)
+	a, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close(ctx)
+	versions, err = a.History(ctx, nil)
 	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`)}, versions)
+}
+
+func TestArchiveReindex(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	ctx := context.Background()
+	cfg := setup(t, ctx)
+	cfg.CacheDir = t.TempDir()
+
+	a, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"foo"}`)))
+	if !assert.NoError(t, a.Close(ctx)) {
+		return
+	}
+
+	// replace the archived database's index with a legacy sha1 index
+	path, _ := a.cached()
+	db, err := bolt.Open(path, 0600, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		var id []byte
+		if err := tx.Bucket([]byte(indexBucket)).ForEach(func(_, v []byte) error {
+			id = bytes.Clone(v)
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket([]byte(indexBucket)); err != nil {
+			return err
+		}
+		index, err := tx.CreateBucket([]byte(indexBucket))
+		if err != nil {
+			return err
+		}
+		sum := sha1.Sum([]byte(`{"id":"foo"}`))
+		return index.Put(sum[:], id)
+	}))
+	assert.NoError(t, db.Close())
+
+	f, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	_, err = a.s3.PutObject(ctx, &s3.PutObjectInput{Bucket: &cfg.Bucket, Key: &cfg.Key, Body: f})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the rebuilt index is uploaded on close, even if no versions are archived
+	cfg.DisableCache = true
+	a, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, a.Close(ctx)) {
+		return
+	}
+
+	obj, err := a.s3.GetObject(ctx, &s3.GetObjectInput{Bucket: &cfg.Bucket, Key: &cfg.Key})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer obj.Body.Close()
+	b, err := io.ReadAll(obj.Body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	path = filepath.Join(t.TempDir(), "archive.db")
+	if !assert.NoError(t, os.WriteFile(path, b, 0600)) {
+		return
+	}
+	db, err = bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	assert.NoError(t, db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(indexBucket)).ForEach(func(k, _ []byte) error {
+			assert.Len(t, k, canonical.Size)
+			return nil
+		})
+	}))
+}
+
+func TestArchiveDir(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
 
-	// open new archive
+	ctx := context.Background()
+	cfg := setup(t, ctx)
+
+	// by default, the database file is created in a private temporary
+	// directory that is removed on close
+	a, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.FileExists(t, filepath.Join(a.tmp, "archive.db"))
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"foo"}`)))
+	assert.NoError(t, a.Close(ctx))
+	assert.NoDirExists(t, a.tmp)
+
+	// a configured directory is created if necessary, and only the database
+	// file is removed on close
+	cfg.Dir = filepath.Join(t.TempDir(), "archive")
 	a, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.FileExists(t, filepath.Join(cfg.Dir, "archive.db"))
+	versions, err := a.History(ctx, nil)
 	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`)}, versions)
+	assert.NoError(t, a.Close(ctx))
+	assert.DirExists(t, cfg.Dir)
+	assert.NoFileExists(t, filepath.Join(cfg.Dir, "archive.db"))
+}
+
+func TestArchiveMetadata(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	ctx := context.Background()
+	cfg := setup(t, ctx)
+
+	a, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	meta := []history.Metadata{{Name: "commit", Value: "abc123"}}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"foo"}`)))
+	assert.NoError(t, a.PutMetadata(ctx, []byte(`{"id":"bar"}`), meta))
+
+	// concurrent modifications are merged along with archived metadata
+	b, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, b.Put(ctx, []byte(`{"id":"baz"}`)))
+	if !assert.NoError(t, b.Close(ctx)) {
+		return
+	}
+	if !assert.NoError(t, a.Close(ctx)) {
+		return
+	}
+
+	a, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
 	defer func() {
-		err = a.Close(ctx)
-		assert.NoError(t, err)
+		assert.NoError(t, a.Close(ctx))
 	}()
+	archived, err := a.Metadata(ctx, []byte(`{ "id": "bar" }`))
+	assert.NoError(t, err)
+	assert.Equal(t, meta, archived)
+	archived, err = a.Metadata(ctx, []byte(`{"id":"foo"}`))
+	assert.NoError(t, err)
+	assert.Nil(t, archived)
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"baz"}`), []byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`)}, versions)
+}
 
-	additional := [][]byte{
-		[]byte(`{"id":"foo"}`),
-		[]byte(`{"id":"z"}`),
-		[]byte(`{"id":"x"}`),
-		[]byte(`{"id":"y"}`),
-		[]byte(`{"id":"a"}`),
-		[]byte(`{"id":"b"}`),
-		[]byte(`{"id":"c"}`),
-		[]byte(`{"id":"g"}`),
-		[]byte(`{"id":"A"}`),
+func TestConfigValidation(t *testing.T) {
+	base := func() Config {
+		return Config{Bucket: "foo", Key: "bar/archive.db", Region: "us-east-1"}
+	}
+	cases := map[string]struct {
+		mutate func(c *Config)
+		err    string
+	}{
+		"assume_role": {
+			mutate: func(c *Config) {
+				c.AssumeRole = &AssumeRole{RoleARN: "arn:aws:iam::123456789012:role/foo", ExternalID: "bar"}
+				c.Profile = "baz"
+			},
+		},
+		"assume_role_missing_arn": {
+			mutate: func(c *Config) {
+				c.AssumeRole = &AssumeRole{ExternalID: "bar"}
+			},
+			err: "RoleARN",
+		},
+		"profile_with_credentials": {
+			mutate: func(c *Config) {
+				c.Credentials = &Credentials{AccessKey: "abc", SecretKey: "123"}
+				c.Profile = "baz"
+			},
+			err: "Profile",
+		},
+		"sse_kms": {
+			mutate: func(c *Config) {
+				c.ServerSideEncryption = &ServerSideEncryption{Algorithm: "aws:kms", KMSKeyID: "alias/foo"}
+			},
+		},
+		"sse_s3_with_kms_key": {
+			mutate: func(c *Config) {
+				c.ServerSideEncryption = &ServerSideEncryption{Algorithm: "AES256", KMSKeyID: "alias/foo"}
+			},
+			err: "kms_key_id requires algorithm aws:kms",
+		},
+		"sse_invalid_algorithm": {
+			mutate: func(c *Config) {
+				c.ServerSideEncryption = &ServerSideEncryption{Algorithm: "foo"}
+			},
+			err: "Algorithm",
+		},
+		"storage_class_invalid": {
+			mutate: func(c *Config) {
+				c.StorageClass = "GLACIER"
+			},
+			err: "StorageClass",
+		},
+		"web_identity": {
+			mutate: func(c *Config) {
+				c.WebIdentity = &WebIdentity{RoleARN: "arn:aws:iam::123456789012:role/foo", TokenFile: "/var/run/token"}
+			},
+		},
+		"web_identity_with_assume_role": {
+			mutate: func(c *Config) {
+				c.AssumeRole = &AssumeRole{RoleARN: "arn:aws:iam::123456789012:role/foo"}
+				c.WebIdentity = &WebIdentity{RoleARN: "arn:aws:iam::123456789012:role/foo", TokenFile: "/var/run/token"}
+			},
+			err: "web_identity cannot be combined",
+		},
+		"web_identity_with_profile": {
+			mutate: func(c *Config) {
+				c.Profile = "baz"
+				c.WebIdentity = &WebIdentity{RoleARN: "arn:aws:iam::123456789012:role/foo", TokenFile: "/var/run/token"}
+			},
+			err: "Profile",
+		},
 	}
 
-	// load additional
-	err = a.Put(ctx, additional...)
+	for desc, c := range cases {
+		t.Run(desc, func(t *testing.T) {
+			cfg := base()
+			c.mutate(&cfg)
+			err := validator.New().Struct(&cfg)
+			if err == nil {
+				err = cfg.validate()
+			}
+			if c.err == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), c.err)
+			}
+		})
+	}
+}
+
+func TestPutObjectInput(t *testing.T) {
+	a := &Archive{cfg: &Config{
+		Bucket: "foo",
+		Key:    "bar/archive.db",
+		ServerSideEncryption: &ServerSideEncryption{
+			Algorithm: "aws:kms",
+			KMSKeyID:  "alias/foo",
+		},
+		StorageClass: "STANDARD_IA",
+		Tags: map[string]string{
+			"team":  "my team",
+			"owner": "a&b",
+		},
+	}}
+
+	input := a.putObjectInput()
+	assert.Equal(t, "foo", *input.Bucket)
+	assert.Equal(t, "bar/archive.db", *input.Key)
+	assert.Equal(t, types.ServerSideEncryptionAwsKms, input.ServerSideEncryption)
+	assert.Equal(t, "alias/foo", *input.SSEKMSKeyId)
+	assert.Equal(t, types.StorageClassStandardIa, input.StorageClass)
+	assert.Equal(t, "owner=a%26b&team=my+team", *input.Tagging)
+
+	a.cfg.ServerSideEncryption, a.cfg.StorageClass, a.cfg.Tags = nil, "", nil
+	input = a.putObjectInput()
+	assert.Empty(t, input.ServerSideEncryption)
+	assert.Nil(t, input.SSEKMSKeyId)
+	assert.Empty(t, input.StorageClass)
+	assert.Nil(t, input.Tagging)
+}
+
+func TestOpenDBTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.db")
+	db, err := bolt.Open(path, 0600, nil)
 	if !assert.NoError(t, err) {
 		return
 	}
+	defer db.Close()
 
-	// retrieve and compare version order
-	versions, err = a.History(ctx, nil)
-	assert.NoError(t, err)
-	assert.Equal(t, [][]byte{
-		[]byte(`{"id":"foo"}`),
-		[]byte(`{"id":"bar"}`),
-		[]byte(`{"id":"baz"}`),
-		[]byte(`{"id":"z"}`),
-		[]byte(`{"id":"x"}`),
-		[]byte(`{"id":"y"}`),
-		[]byte(`{"id":"a"}`),
-		[]byte(`{"id":"b"}`),
-		[]byte(`{"id":"c"}`),
-		[]byte(`{"id":"g"}`),
-		[]byte(`{"id":"A"}`),
-	}, versions)
+	_, err = openDB(path, 50*time.Millisecond, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timed out after 50ms waiting for lock")
+	}
 }
@@ -0,0 +1,145 @@
+package boltdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/fatih/color"
+)
+
+const cacheExt = ".db"
+
+// cacheDir returns the directory containing cached copies of the configured
+// database object, or an empty string if caching is disabled
+func (a *Archive) cacheDir() string {
+	if a.cfg.DisableCache {
+		return ""
+	}
+	dir := a.cfg.CacheDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "concourse-go-sdk", "boltdb")
+	}
+	sum := sha256.Sum256([]byte(a.cfg.Bucket + "/" + a.cfg.Key))
+	return filepath.Join(dir, hex.EncodeToString(sum[:]))
+}
+
+// cached returns the path and ETag of the most recently cached copy of the
+// database object, if any. Cached files are named after the hex encoded ETag
+// of the object they were downloaded from or uploaded as, so that a file and
+// its ETag are always replaced atomically
+func (a *Archive) cached() (path string, etag *string) {
+	dir := a.cacheDir()
+	if dir == "" {
+		return "", nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", nil
+	}
+
+	var latest time.Time
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, cacheExt) {
+			continue
+		}
+		raw, err := hex.DecodeString(strings.TrimSuffix(name, cacheExt))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || (etag != nil && info.ModTime().Before(latest)) {
+			continue
+		}
+		path, etag, latest = filepath.Join(dir, name), aws.String(string(raw)), info.ModTime()
+	}
+	return path, etag
+}
+
+// restore copies the cached database file at path to the local database file
+func (a *Archive) restore(path string) (string, error) {
+	if err := copyFile(path, a.path); err != nil {
+		return "", fmt.Errorf("error restoring cached database: %v", err)
+	}
+	return a.path, nil
+}
+
+// store caches a copy of the local database file under the given ETag,
+// removing any previously cached copies. Failures are logged rather than
+// returned, as the cache is purely an optimization
+func (a *Archive) store(etag *string) {
+	dir := a.cacheDir()
+	if dir == "" || etag == nil {
+		return
+	}
+
+	err := func() error {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		tmp, err := os.CreateTemp(dir, "*.tmp")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		if err := copyFile(a.path, tmp.Name()); err != nil {
+			return err
+		}
+		name := hex.EncodeToString([]byte(*etag)) + cacheExt
+		if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Name() != name && strings.HasSuffix(entry.Name(), cacheExt) {
+				os.Remove(filepath.Join(dir, entry.Name()))
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		color.Yellow("error caching database: %v", err)
+	}
+}
+
+// copyFile copies the contents of the file at src to dst, replacing dst if
+// it exists
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// isNotModified returns true if the error indicates that a conditional
+// request failed because the object matches the provided ETag
+func isNotModified(err error) bool {
+	var re interface{ HTTPStatusCode() int }
+	return errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotModified
+}
@@ -0,0 +1,149 @@
+package boltdb
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// compressionMetadataKey is the S3 object metadata key used to record the
+	// compression algorithm applied to an uploaded database file
+	compressionMetadataKey = "compression"
+
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// compress returns a writer that compresses data written to w using the
+// given algorithm
+func compress(w io.Writer, algorithm string) (io.WriteCloser, error) {
+	switch algorithm {
+	case compressionGzip:
+		return gzip.NewWriter(w), nil
+	case compressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", algorithm)
+	}
+}
+
+// compressFile compresses the contents of f into a temporary file, which is
+// returned positioned at the beginning and must be removed by the caller
+func compressFile(f *os.File, algorithm string) (*os.File, error) {
+	out, err := os.CreateTemp(filepath.Dir(f.Name()), filepath.Base(f.Name())+".*."+algorithm)
+	if err != nil {
+		return nil, fmt.Errorf("error creating compressed database file: %v", err)
+	}
+
+	err = func() error {
+		w, err := compress(out, algorithm)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, f); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		_, err = out.Seek(0, io.SeekStart)
+		return err
+	}()
+	if err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return nil, fmt.Errorf("error compressing database file: %v", err)
+	}
+	return out, nil
+}
+
+// decompress returns a reader that decompresses data read from r using the
+// given algorithm
+func decompress(r io.Reader, algorithm string) (io.ReadCloser, error) {
+	switch algorithm {
+	case compressionGzip:
+		return gzip.NewReader(r)
+	case compressionZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", algorithm)
+	}
+}
+
+// compact rewrites the database file at path into a fresh file, discarding
+// free pages accumulated by previous writes
+func compact(path string, timeout time.Duration) error {
+	src, err := openDB(path, timeout, true)
+	if err != nil {
+		return fmt.Errorf("error opening database for compaction: %v", err)
+	}
+
+	tmp := path + ".compact"
+	err = copyDB(src, tmp)
+	if cerr := src.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("error closing database: %v", cerr)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error replacing compacted database: %v", err)
+	}
+	return nil
+}
+
+// copyDB copies all buckets in src to a new database file at path
+func copyDB(src *bolt.DB, path string) error {
+	dst, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return fmt.Errorf("error creating compacted database: %v", err)
+	}
+	err = src.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(b, nb)
+			})
+		})
+	})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error compacting database: %v", err)
+	}
+	return nil
+}
+
+// copyBucket recursively copies all keys and nested buckets from src to dst
+func copyBucket(src, dst *bolt.Bucket) error {
+	dst.FillPercent = 1.0
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nested, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(src.Bucket(k), nested)
+	})
+}
@@ -0,0 +1,60 @@
+package boltdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive/internal/awsutil"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/lock"
+)
+
+const lockSuffix = ".lock"
+
+// TryLock attempts to acquire the archive lock by conditionally creating a
+// lock object alongside the database object (e.g. archive.db.lock), which
+// records the owner and expiry of the lease. The lock is shared by every
+// namespace within the database object. An expired lease is stolen, if
+// permitted, by conditionally replacing the lock object, with expiry
+// evaluated using the local clock. Once acquired, the database is reloaded to
+// include versions archived by the previous holder, and until released, Close
+// confirms that the lease is still held before uploading the database.
+func (a *Archive) TryLock(ctx context.Context, req lock.Request) (lock.Lease, error) {
+	l := &awsutil.Lock{Bucket: a.cfg.Bucket, Client: a.s3, Key: a.cfg.Key + lockSuffix}
+	held, err := l.TryLock(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.refresh(ctx); err != nil {
+		held.Release(ctx)
+		return nil, err
+	}
+	a.lease = held
+	return &lease{Lease: held, a: a}, nil
+}
+
+// lease describes an archive lock held by the archive
+type lease struct {
+	*awsutil.Lease
+	a *Archive
+}
+
+// Release releases the archive lock, after which Close no longer confirms
+// that the lease is held before uploading the database
+func (l *lease) Release(ctx context.Context) error {
+	if l.a.lease == l.Lease {
+		l.a.lease = nil
+	}
+	return l.Lease.Release(ctx)
+}
+
+// refresh reloads the database downloaded when the archive was opened,
+// which may have been modified by the previous holder of the archive lock
+func (a *Archive) refresh(ctx context.Context) error {
+	if err := a.db.Close(); err != nil {
+		return fmt.Errorf("error closing database: %v", err)
+	}
+	if err := a.reload(ctx); err != nil {
+		return fmt.Errorf("error reloading database: %v", err)
+	}
+	return nil
+}
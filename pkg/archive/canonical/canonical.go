@@ -0,0 +1,58 @@
+// Package canonical provides a stable identity for serialized resource
+// versions that is shared by the sdk and all archive backends, such that
+// version de-duplication does not depend on the serializer, key order, or
+// whitespace used to produce a particular version.
+package canonical
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
+// Size is the length in bytes of a version hash
+const Size = sha256.Size
+
+// Marshal returns the canonical json encoding of v
+func Marshal(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return Normalize(b)
+}
+
+// Normalize rewrites a json document in canonical form: object keys are
+// sorted, insignificant whitespace is removed, string escapes are normalized,
+// and numbers are preserved verbatim
+func Normalize(b []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("error parsing version: %w", err)
+	}
+	if d.More() {
+		return nil, fmt.Errorf("error parsing version: unexpected data after top-level value")
+	}
+
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return nil, fmt.Errorf("error encoding version: %w", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Hash returns the sha256 digest of the canonical form of the given json
+// serialized version
+func Hash(b []byte) ([Size]byte, error) {
+	normalized, err := Normalize(b)
+	if err != nil {
+		return [Size]byte{}, err
+	}
+	return sha256.Sum256(normalized), nil
+}
@@ -0,0 +1,37 @@
+package canonical
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHash(t *testing.T) {
+	expected, err := Hash([]byte(`{"a":"1","b":"<2>"}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, raw := range []string{
+		`{"b":"<2>","a":"1"}`,
+		"{\n  \"a\": \"1\",\n  \"b\": \"\\u003c2\\u003e\"\n}",
+		` {"b" : "<2>" , "a" : "1"} `,
+	} {
+		actual, err := Hash([]byte(raw))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual, raw)
+	}
+
+	other, err := Hash([]byte(`{"a":"1","b":"2"}`))
+	assert.NoError(t, err)
+	assert.NotEqual(t, expected, other)
+
+	_, err = Hash([]byte(`{"a":"1"}{}`))
+	assert.Error(t, err)
+}
+
+func TestNormalize(t *testing.T) {
+	actual, err := Normalize([]byte(`{ "z": "<&>", "a": {"d": 1.50, "c": [true, null]} }`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":{"c":[true,null],"d":1.50},"z":"<&>"}`, string(actual))
+}
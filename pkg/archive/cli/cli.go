@@ -0,0 +1,401 @@
+// Package cli implements a command line tool for inspecting, exporting,
+// importing, and deleting archived version history, supporting every
+// registered archive backend. Resources that register custom backends can
+// build their own tool by invoking Main after registration.
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive"
+	"github.com/fatih/color"
+)
+
+const (
+	configEnv        = "CONCOURSE_ARCHIVE_CONFIG"
+	defaultBatchSize = 100
+	maxLineSize      = 16 * 1024 * 1024
+)
+
+// command describes a single subcommand
+type command struct {
+	usage string
+	desc  string
+	run   func(ctx context.Context, env *env, args []string) error
+}
+
+// env describes the inputs and outputs available to a subcommand
+type env struct {
+	config string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+var commands = map[string]command{
+	"delete": {
+		usage: "delete <version>...",
+		desc:  "delete the given json versions from the archive",
+		run:   runDelete,
+	},
+	"export": {
+		usage: "export [-o file]",
+		desc:  "export archived versions as json lines, oldest first",
+		run:   runExport,
+	},
+	"import": {
+		usage: "import [-batch-size n] [file]",
+		desc:  "import versions from json lines (default: stdin), skipping archived versions",
+		run:   runImport,
+	},
+	"list": {
+		usage: "list",
+		desc:  "list archived versions along with the time each was archived",
+		run:   runList,
+	},
+	"migrate": {
+		usage: "migrate -to file [-batch-size n]",
+		desc:  "copy archived versions to the archive described by another config file, resuming interrupted migrations",
+		run:   runMigrate,
+	},
+	"stats": {
+		usage: "stats",
+		desc:  "show archive statistics",
+		run:   runStats,
+	},
+}
+
+// Main runs the archive command line tool using the process arguments and
+// standard streams, exiting with a non-zero status on failure
+func Main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer cancel()
+
+	if err := Run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			color.New(color.FgRed).Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+// Run executes the archive command line tool with the given arguments, which
+// exclude the program name
+func Run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("concourse-archive", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	e := &env{stdin: stdin, stdout: stdout, stderr: stderr}
+	fs.StringVar(&e.config, "config", os.Getenv(configEnv), "path to a json archive config file (env: "+configEnv+")")
+	fs.Usage = func() { usage(fs) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown command %q, expected one of: %s", fs.Arg(0), strings.Join(names(), ", "))
+	}
+	return cmd.run(ctx, e, fs.Args()[1:])
+}
+
+// usage prints the tool's usage
+func usage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintf(w, "Usage: %s [-config file] <command> [args]\n\nCommands:\n", fs.Name())
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range names() {
+		fmt.Fprintf(tw, "  %s\t%s\n", commands[name].usage, commands[name].desc)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nFlags:\n")
+	fs.PrintDefaults()
+}
+
+// names returns the sorted list of command names
+func names() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// open parses the archive config file and initializes the archive
+func (e *env) open(ctx context.Context) (archive.Archive, error) {
+	if e.config == "" {
+		return nil, errors.New("missing archive config, specify -config or " + configEnv)
+	}
+	cfg, err := readConfig(e.config)
+	if err != nil {
+		return nil, err
+	}
+	return archive.New(ctx, *cfg)
+}
+
+// readConfig parses the json archive config file at the given path
+func readConfig(path string) (*archive.Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive config: %v", err)
+	}
+	var cfg archive.Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("error parsing archive config: %v", err)
+	}
+	return &cfg, nil
+}
+
+// with initializes the archive, invokes fn, and closes the archive,
+// persisting any changes
+func (e *env) with(ctx context.Context, fn func(archive.Archive) error) (err error) {
+	a, err := e.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := a.Close(ctx); err == nil && cerr != nil {
+			err = fmt.Errorf("error closing archive: %v", cerr)
+		}
+	}()
+	return fn(a)
+}
+
+func runDelete(ctx context.Context, e *env, args []string) error {
+	if len(args) == 0 {
+		return errors.New("delete requires at least one version")
+	}
+	versions := make([][]byte, len(args))
+	for i, arg := range args {
+		if !json.Valid([]byte(arg)) {
+			return fmt.Errorf("invalid version %q: expected json", arg)
+		}
+		versions[i] = []byte(arg)
+	}
+
+	return e.with(ctx, func(a archive.Archive) error {
+		n, err := archive.Delete(ctx, a, versions...)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "deleted %d version(s)\n", n)
+		return nil
+	})
+}
+
+func runExport(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	output := fs.String("o", "", "path to the output file (default: stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return e.with(ctx, func(a archive.Archive) error {
+		entries, err := archive.List(ctx, a)
+		if err != nil {
+			return err
+		}
+
+		if *output == "" {
+			return export(e.stdout, entries)
+		}
+		f, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("error creating output file: %v", err)
+		}
+		if err := export(f, entries); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("error writing output file: %v", err)
+		}
+		return nil
+	})
+}
+
+// export writes each entry's version to w as a single json line
+func export(w io.Writer, entries []archive.Entry) error {
+	bw := bufio.NewWriter(w)
+	for _, entry := range entries {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, entry.Version); err != nil {
+			return fmt.Errorf("error exporting version %s: %v", entry.Version, err)
+		}
+		buf.WriteByte('\n')
+		bw.Write(buf.Bytes())
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing versions: %v", err)
+	}
+	return nil
+}
+
+func runImport(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	batchSize := fs.Int("batch-size", defaultBatchSize, "number of versions to archive per request")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *batchSize <= 0 {
+		return errors.New("batch-size must be greater than 0")
+	}
+
+	r := e.stdin
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error opening input file: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	// parse all versions prior to opening the archive, so that invalid input
+	// leaves the archive unmodified
+	var versions [][]byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			return fmt.Errorf("invalid version on line %d: expected json", n)
+		}
+		versions = append(versions, bytes.Clone(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading versions: %v", err)
+	}
+
+	return e.with(ctx, func(a archive.Archive) error {
+		for start := 0; start < len(versions); start += *batchSize {
+			end := start + *batchSize
+			if end > len(versions) {
+				end = len(versions)
+			}
+			if err := a.Put(ctx, versions[start:end]...); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(e.stdout, "imported %d version(s)\n", len(versions))
+		return nil
+	})
+}
+
+func runList(ctx context.Context, e *env, args []string) error {
+	return e.with(ctx, func(a archive.Archive) error {
+		entries, err := archive.List(ctx, a)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(e.stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ARCHIVED\tVERSION")
+		for _, entry := range entries {
+			fmt.Fprintf(tw, "%s\t%s\n", formatTime(entry.Archived), entry.Version)
+		}
+		return tw.Flush()
+	})
+}
+
+func runMigrate(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	to := fs.String("to", "", "path to the json config file of the destination archive")
+	batchSize := fs.Int("batch-size", defaultBatchSize, "number of versions to archive per request")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *to == "" {
+		return errors.New("migrate requires a destination archive config, specify -to")
+	}
+	if *batchSize <= 0 {
+		return errors.New("batch-size must be greater than 0")
+	}
+	if e.config == "" {
+		return errors.New("missing archive config, specify -config or " + configEnv)
+	}
+
+	src, err := readConfig(e.config)
+	if err != nil {
+		return err
+	}
+	dst, err := readConfig(*to)
+	if err != nil {
+		return fmt.Errorf("error reading destination archive config: %v", err)
+	}
+
+	result, err := archive.Migrate(ctx, *src, *dst,
+		archive.WithMigrateBatchSize(*batchSize),
+		archive.WithMigrateProgress(func(done, total int) {
+			fmt.Fprintf(e.stderr, "migrated %d/%d version(s)\n", done, total)
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(e.stdout, "migrated %d version(s), skipped %d already present, verified %d version(s)\n", result.Copied, result.Skipped, result.Total)
+	return nil
+}
+
+func runStats(ctx context.Context, e *env, args []string) error {
+	return e.with(ctx, func(a archive.Archive) error {
+		entries, err := archive.List(ctx, a)
+		if err != nil {
+			return err
+		}
+
+		var oldest, newest time.Time
+		var size, unknown int
+		for _, entry := range entries {
+			size += len(entry.Version)
+			switch {
+			case entry.Archived.IsZero():
+				unknown++
+				continue
+			case oldest.IsZero() || entry.Archived.Before(oldest):
+				oldest = entry.Archived
+			}
+			if entry.Archived.After(newest) {
+				newest = entry.Archived
+			}
+		}
+
+		tw := tabwriter.NewWriter(e.stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "versions:\t%d\n", len(entries))
+		fmt.Fprintf(tw, "size:\t%d bytes\n", size)
+		fmt.Fprintf(tw, "oldest:\t%s\n", formatTime(oldest))
+		fmt.Fprintf(tw, "newest:\t%s\n", formatTime(newest))
+		fmt.Fprintf(tw, "unknown archive time:\t%d\n", unknown)
+		return tw.Flush()
+	})
+}
+
+// formatTime formats an archive time, which is zero if unknown
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
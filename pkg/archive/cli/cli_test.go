@@ -0,0 +1,140 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	// register archive backends used by tests
+	_ "github.com/cludden/concourse-go-sdk/pkg/archive/file"
+	_ "github.com/cludden/concourse-go-sdk/pkg/archive/sql"
+)
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.json")
+	err := os.WriteFile(config, []byte(fmt.Sprintf(`{"file":{"path":%q}}`, filepath.Join(dir, "archive.jsonl"))), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	run := func(stdin string, args ...string) (string, error) {
+		var stdout, stderr bytes.Buffer
+		err := Run(ctx, append([]string{"-config", config}, args...), strings.NewReader(stdin), &stdout, &stderr)
+		return stdout.String(), err
+	}
+
+	// import versions from stdin
+	out, err := run("{\"id\":\"foo\"}\n\n{ \"id\": \"bar\" }\n{\"id\":\"foo\"}\n", "import", "-batch-size", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "imported 3 version(s)\n", out)
+
+	// invalid input leaves the archive unmodified
+	_, err = run("{\"id\":\"baz\"}\nnot json\n", "import")
+	assert.EqualError(t, err, "invalid version on line 2: expected json")
+
+	// list versions along with the time each was archived
+	out, err = run("", "list")
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Regexp(t, `^ARCHIVED\s+VERSION$`, lines[0])
+		assert.Regexp(t, `^\d{4}-\d{2}-\d{2}T\S+Z\s+\{"id":"foo"\}$`, lines[1])
+		assert.Regexp(t, `^\d{4}-\d{2}-\d{2}T\S+Z\s+\{"id":"bar"\}$`, lines[2])
+	}
+
+	// show statistics
+	out, err = run("", "stats")
+	assert.NoError(t, err)
+	assert.Regexp(t, `versions:\s+2\n`, out)
+	assert.Regexp(t, `size:\s+24 bytes\n`, out)
+	assert.Regexp(t, `unknown archive time:\s+0\n`, out)
+
+	// export versions as json lines to a file
+	export := filepath.Join(dir, "export.jsonl")
+	_, err = run("", "export", "-o", export)
+	assert.NoError(t, err)
+	b, err := os.ReadFile(export)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"id\":\"foo\"}\n{\"id\":\"bar\"}\n", string(b))
+
+	// delete versions
+	out, err = run("", "delete", `{"id":"foo"}`, `{"id":"qux"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "deleted 1 version(s)\n", out)
+	out, err = run("", "export")
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"id\":\"bar\"}\n", out)
+
+	// import previously exported versions from a file
+	out, err = run("", "import", export)
+	assert.NoError(t, err)
+	assert.Equal(t, "imported 2 version(s)\n", out)
+	out, err = run("", "export")
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"id\":\"bar\"}\n{\"id\":\"foo\"}\n", out)
+
+	// migrate versions to another backend
+	dst := filepath.Join(dir, "dst.json")
+	err = os.WriteFile(dst, []byte(fmt.Sprintf(`{"sql":{"driver":"sqlite","dsn":%q}}`, filepath.Join(dir, "archive.sqlite"))), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	out, err = run("", "migrate", "-to", dst, "-batch-size", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "migrated 2 version(s), skipped 0 already present, verified 2 version(s)\n", out)
+	out, err = run("", "migrate", "-to", dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "migrated 0 version(s), skipped 2 already present, verified 2 version(s)\n", out)
+}
+
+func TestRunErrors(t *testing.T) {
+	ctx := context.Background()
+	cases := map[string]struct {
+		args []string
+		err  string
+	}{
+		"missing_config": {
+			args: []string{"list"},
+			err:  "missing archive config, specify -config or CONCOURSE_ARCHIVE_CONFIG",
+		},
+		"unknown_command": {
+			args: []string{"-config", "archive.json", "foo"},
+			err:  `unknown command "foo", expected one of: delete, export, import, list, migrate, stats`,
+		},
+		"delete_missing_versions": {
+			args: []string{"-config", "archive.json", "delete"},
+			err:  "delete requires at least one version",
+		},
+		"delete_invalid_version": {
+			args: []string{"-config", "archive.json", "delete", "foo"},
+			err:  `invalid version "foo": expected json`,
+		},
+		"migrate_missing_destination": {
+			args: []string{"-config", "archive.json", "migrate"},
+			err:  "migrate requires a destination archive config, specify -to",
+		},
+		"unknown_backend": {
+			args: []string{"-config", filepath.Join("testdata", "unknown.json"), "list"},
+			err:  `unknown archive backend "foo"`,
+		},
+	}
+
+	t.Setenv(configEnv, "")
+	for desc, c := range cases {
+		t.Run(desc, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := Run(ctx, c.args, strings.NewReader(""), &stdout, &stderr)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), c.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package archive
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/history"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"golang.org/x/crypto/argon2"
+)
+
+// encryptedMetadata is the name of the single metadata entry used to persist
+// encrypted metadata
+const encryptedMetadata = "$encrypted"
+
+// encrypted wraps an Archive, encrypting each version before it is persisted
+// and decrypting versions as they are read. Versions are sealed with AES-GCM
+// using a nonce derived from the version's canonical form, so that identical
+// versions produce identical ciphertext and remain de-duplicated by the
+// underlying backend. Unencrypted versions, archived before encryption was
+// enabled, are returned as-is. Versions that have already been archived,
+// whether unencrypted or sealed using a previous key, are matched in the form
+// they were archived, so that rotating keys never duplicates versions.
+type encrypted struct {
+	Archive
+	keys []*encryptionKey
+}
+
+// encryptionKey describes a parsed encryption key
+type encryptionKey struct {
+	aead  cipher.AEAD
+	id    string
+	nonce []byte
+}
+
+// envelope describes the json representation of an encrypted version
+type envelope struct {
+	Encrypted *sealed `json:"$encrypted"`
+}
+
+// sealed describes an encrypted version, along with the id of the key used
+// to encrypt it
+type sealed struct {
+	Data []byte `json:"data"`
+	KID  string `json:"kid"`
+}
+
+// newEncryptionKeys parses and derives the configured encryption keys
+func newEncryptionKeys(cfg *settings.Encryption) ([]*encryptionKey, error) {
+	keys := make([]*encryptionKey, 0, len(cfg.Keys))
+	for i, k := range cfg.Keys {
+		var secret []byte
+		if k.Passphrase != "" {
+			secret = argon2.IDKey([]byte(k.Passphrase), []byte(k.Salt), 3, 64*1024, 4, 32)
+		} else {
+			b, err := base64.StdEncoding.DecodeString(k.Key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid encryption key %d: %v", i, err)
+			}
+			if len(b) != 32 {
+				return nil, fmt.Errorf("invalid encryption key %d: expected 32 bytes, got %d", i, len(b))
+			}
+			secret = b
+		}
+
+		block, err := aes.NewCipher(derive(secret, "encrypt"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %v", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %v", i, err)
+		}
+		keys = append(keys, &encryptionKey{
+			aead:  aead,
+			id:    hex.EncodeToString(derive(secret, "id")[:4]),
+			nonce: derive(secret, "nonce"),
+		})
+	}
+	return keys, nil
+}
+
+// derive derives a purpose specific subkey from the given secret
+func derive(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (e *encrypted) History(ctx context.Context, latest []byte) ([][]byte, error) {
+	return history.Collect(e.HistoryIter(ctx, latest, 0))
+}
+
+// HistoryIter returns an iterator over the decrypted versions returned by the
+// underlying archive, matching the latest version in the form it was archived
+func (e *encrypted) HistoryIter(ctx context.Context, latest []byte, pageSize int) Seq {
+	return func(yield func([]byte, error) bool) {
+		if latest != nil {
+			var err error
+			if latest, err = e.resolve(ctx, latest); err != nil {
+				yield(nil, err)
+				return
+			}
+		}
+
+		HistoryIter(ctx, e.Archive, latest, pageSize)(func(version []byte, err error) bool {
+			if err != nil {
+				return yield(nil, err)
+			}
+			plaintext, err := e.open(version)
+			if err != nil {
+				yield(nil, err)
+				return false
+			}
+			return yield(plaintext, nil)
+		})
+	}
+}
+
+// Put encrypts versions using the primary key before archiving them, while
+// versions that have already been archived are re-archived in the form they
+// were archived
+func (e *encrypted) Put(ctx context.Context, versions ...[]byte) error {
+	resolved := make([][]byte, len(versions))
+	for i, version := range versions {
+		var err error
+		if resolved[i], err = e.resolve(ctx, version); err != nil {
+			return err
+		}
+	}
+	return e.Archive.Put(ctx, resolved...)
+}
+
+// List returns the decrypted versions listed by the underlying archive
+func (e *encrypted) List(ctx context.Context) ([]Entry, error) {
+	entries, err := List(ctx, e.Archive)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if entries[i].Version, err = e.open(entries[i].Version); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Delete removes the given versions from the underlying archive, matching
+// unencrypted copies and copies encrypted using any configured key
+func (e *encrypted) Delete(ctx context.Context, versions ...[]byte) (int, error) {
+	targets := make([][]byte, 0, len(versions)*(len(e.keys)+1))
+	for _, version := range versions {
+		candidates, err := e.candidates(version)
+		if err != nil {
+			return 0, err
+		}
+		targets = append(targets, candidates...)
+	}
+	return Delete(ctx, e.Archive, targets...)
+}
+
+// PutMetadata encrypts a version along with its metadata, which is persisted
+// by the underlying archive as a single entry containing the sealed metadata.
+// Versions that have already been archived are matched in the form they were
+// archived.
+func (e *encrypted) PutMetadata(ctx context.Context, version []byte, metadata []Metadata) error {
+	sealedVersion, err := e.resolve(ctx, version)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("error serializing metadata: %v", err)
+	}
+	sealedMetadata, err := e.keys[0].seal(b)
+	if err != nil {
+		return err
+	}
+	return PutMetadata(ctx, e.Archive, sealedVersion, []Metadata{{Name: encryptedMetadata, Value: string(sealedMetadata)}})
+}
+
+// Metadata returns the decrypted metadata archived alongside the given
+// version, matching unencrypted copies and copies encrypted using any
+// configured key
+func (e *encrypted) Metadata(ctx context.Context, version []byte) ([]Metadata, error) {
+	candidates, err := e.candidates(version)
+	if err != nil {
+		return nil, err
+	}
+	for _, candidate := range candidates {
+		metadata, err := GetMetadata(ctx, e.Archive, candidate)
+		if err != nil {
+			return nil, err
+		}
+		if metadata == nil {
+			continue
+		}
+		if len(metadata) != 1 || metadata[0].Name != encryptedMetadata {
+			return metadata, nil
+		}
+		plaintext, err := e.open([]byte(metadata[0].Value))
+		if err != nil {
+			return nil, err
+		}
+		var decrypted []Metadata
+		if err := json.Unmarshal(plaintext, &decrypted); err != nil {
+			return nil, fmt.Errorf("error parsing decrypted metadata: %v", err)
+		}
+		return decrypted, nil
+	}
+	return nil, nil
+}
+
+// Has returns true if the given version has been archived, whether
+// unencrypted or encrypted using any configured key
+func (e *encrypted) Has(ctx context.Context, version []byte) (bool, error) {
+	candidates, err := e.candidates(version)
+	if err != nil {
+		return false, err
+	}
+	for _, candidate := range candidates {
+		if found, err := Has(ctx, e.Archive, candidate); err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// TryLock acquires the underlying archive's lock, returning a nil Lease if the
+// underlying archive does not implement Locker
+func (e *encrypted) TryLock(ctx context.Context, req LockRequest) (Lease, error) {
+	if l, ok := e.Archive.(Locker); ok {
+		return l.TryLock(ctx, req)
+	}
+	return nil, nil
+}
+
+// candidates returns every form in which a version may have been archived,
+// sealed using each configured key in order, followed by the unencrypted
+// version
+func (e *encrypted) candidates(version []byte) ([][]byte, error) {
+	candidates := make([][]byte, 0, len(e.keys)+1)
+	for _, key := range e.keys {
+		sealed, err := key.seal(version)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, sealed)
+	}
+	return append(candidates, version), nil
+}
+
+// resolve returns the form in which a version has already been archived, or
+// the version sealed using the primary key if it has not been archived. Each
+// form is looked up in the underlying archive individually, starting with the
+// primary key, and falling back to previous keys and the unencrypted version
+// only if the preceding form has not been archived.
+func (e *encrypted) resolve(ctx context.Context, version []byte) ([]byte, error) {
+	primary, err := e.keys[0].seal(version)
+	if err != nil {
+		return nil, err
+	}
+	if found, err := Has(ctx, e.Archive, primary); err != nil || found {
+		return primary, err
+	}
+	for _, key := range e.keys[1:] {
+		sealed, err := key.seal(version)
+		if err != nil {
+			return nil, err
+		}
+		if found, err := Has(ctx, e.Archive, sealed); err != nil || found {
+			return sealed, err
+		}
+	}
+	if found, err := Has(ctx, e.Archive, version); err != nil || found {
+		return version, err
+	}
+	return primary, nil
+}
+
+// open decrypts an archived version, returning unencrypted versions as-is
+func (e *encrypted) open(version []byte) ([]byte, error) {
+	var env envelope
+	if err := json.Unmarshal(version, &env); err != nil || env.Encrypted == nil {
+		return version, nil
+	}
+
+	for _, key := range e.keys {
+		if key.id != env.Encrypted.KID {
+			continue
+		}
+		n := key.aead.NonceSize()
+		if len(env.Encrypted.Data) < n {
+			return nil, fmt.Errorf("error decrypting archived version: invalid ciphertext")
+		}
+		plaintext, err := key.aead.Open(nil, env.Encrypted.Data[:n], env.Encrypted.Data[n:], []byte(key.id))
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting archived version: authentication failed using key %s, the key is incorrect or the version was modified", key.id)
+		}
+		return plaintext, nil
+	}
+	return nil, fmt.Errorf("error decrypting archived version: no configured encryption key matches key id %s, verify the archive encryption keys", env.Encrypted.KID)
+}
+
+// seal encrypts a version using the key
+func (key *encryptionKey) seal(version []byte) ([]byte, error) {
+	normalized, err := canonical.Normalize(version)
+	if err != nil {
+		return nil, fmt.Errorf("error normalizing version: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, key.nonce)
+	mac.Write(normalized)
+	nonce := mac.Sum(nil)[:key.aead.NonceSize()]
+
+	b, err := json.Marshal(envelope{Encrypted: &sealed{
+		Data: key.aead.Seal(nonce, nonce, normalized, []byte(key.id)),
+		KID:  key.id,
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting version: %v", err)
+	}
+	return b, nil
+}
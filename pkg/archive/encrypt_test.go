@@ -0,0 +1,238 @@
+package archive_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryption(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	keyA := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32)))
+	keyB := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 32)))
+
+	open := func(t *testing.T, keys string) (archive.Archive, error) {
+		var cfg archive.Config
+		raw := fmt.Sprintf(`{"encryption":{"keys":%s},"file":{"path":%q}}`, keys, path)
+		if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+			return nil, err
+		}
+		return archive.New(ctx, cfg)
+	}
+
+	// seed archive with a plaintext version archived prior to enabling
+	// encryption
+	err := os.WriteFile(path, []byte(`{"id":"01H00000000000000000000000","version":{"url":"plaintext"}}`+"\n"), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// archive versions using key A
+	a, err := open(t, fmt.Sprintf(`[{"key":%q}]`, keyA))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"url":"https://internal.example.com/a"}`), []byte(`{ "url": "https://internal.example.com/a" }`)))
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"url":"plaintext"}`),
+		[]byte(`{"url":"https://internal.example.com/a"}`),
+	}, versions)
+	assert.NoError(t, a.Close(ctx))
+
+	// versions are not persisted in plaintext
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "internal.example.com")
+
+	// wrong key results in a clear error
+	a, err = open(t, fmt.Sprintf(`[{"key":%q}]`, keyB))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = a.History(ctx, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no configured encryption key matches key id")
+	}
+	assert.NoError(t, a.Close(ctx))
+
+	// rotate to key B, retaining key A for decryption
+	a, err = open(t, fmt.Sprintf(`[{"key":%q},{"key":%q}]`, keyB, keyA))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"url":"https://internal.example.com/b"}`)))
+	versions, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"url":"plaintext"}`),
+		[]byte(`{"url":"https://internal.example.com/a"}`),
+		[]byte(`{"url":"https://internal.example.com/b"}`),
+	}, versions)
+
+	// list decrypted versions
+	entries, err := archive.List(ctx, a)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, []byte(`{"url":"https://internal.example.com/a"}`), entries[1].Version)
+	}
+
+	// delete plaintext versions and versions encrypted using any key
+	n, err := archive.Delete(ctx, a, []byte(`{"url":"plaintext"}`), []byte(`{"url":"https://internal.example.com/a"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	versions, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"url":"https://internal.example.com/b"}`),
+	}, versions)
+	assert.NoError(t, a.Close(ctx))
+}
+
+func TestEncryptionRotation(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	keyA := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32)))
+	keyB := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 32)))
+
+	open := func(t *testing.T, keys string) (archive.Archive, error) {
+		var cfg archive.Config
+		raw := fmt.Sprintf(`{"encryption":{"keys":%s},"incremental":true,"file":{"path":%q}}`, keys, path)
+		if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+			return nil, err
+		}
+		return archive.New(ctx, cfg)
+	}
+
+	// seed archive with a plaintext version archived prior to enabling
+	// encryption
+	err := os.WriteFile(path, []byte(`{"id":"01H00000000000000000000000","version":{"id":"plaintext"}}`+"\n"), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// archive versions using key A
+	a, err := open(t, fmt.Sprintf(`[{"key":%q}]`, keyA))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"a"}`), []byte(`{"id":"b"}`)))
+	assert.NoError(t, a.Close(ctx))
+
+	// rotate to key B, retaining key A for decryption
+	a, err = open(t, fmt.Sprintf(`[{"key":%q},{"key":%q}]`, keyB, keyA))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close(ctx)
+
+	// re-archiving versions archived using key A or prior to enabling
+	// encryption does not duplicate them
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"plaintext"}`), []byte(`{"id":"a"}`), []byte(`{"id":"c"}`)))
+	assert.NoError(t, archive.PutMetadata(ctx, a, []byte(`{"id":"b"}`), []archive.Metadata{{Name: "foo", Value: "bar"}}))
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"id":"plaintext"}`),
+		[]byte(`{"id":"a"}`),
+		[]byte(`{"id":"b"}`),
+		[]byte(`{"id":"c"}`),
+	}, versions)
+
+	// latest versions archived using key A or prior to enabling encryption
+	// are matched
+	versions, err = a.History(ctx, []byte(`{"id":"a"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"b"}`), []byte(`{"id":"c"}`)}, versions)
+	versions, err = a.History(ctx, []byte(`{"id":"plaintext"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"a"}`), []byte(`{"id":"b"}`), []byte(`{"id":"c"}`)}, versions)
+
+	// versions are found in any form in which they were archived
+	for _, id := range []string{"plaintext", "a", "c"} {
+		found, err := archive.Has(ctx, a, []byte(fmt.Sprintf(`{"id":%q}`, id)))
+		assert.NoError(t, err)
+		assert.True(t, found, id)
+	}
+	found, err := archive.Has(ctx, a, []byte(`{"id":"d"}`))
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestEncryptionMetadata(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32)))
+	var cfg archive.Config
+	err := json.Unmarshal([]byte(fmt.Sprintf(`{"encryption":{"keys":[{"key":%q}]},"file":{"path":%q}}`, key, path)), &cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	a, err := archive.New(ctx, cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close(ctx)
+
+	meta := []archive.Metadata{{Name: "url", Value: "https://internal.example.com/a"}}
+	assert.NoError(t, archive.PutMetadata(ctx, a, []byte(`{"id":"foo"}`), meta))
+	archived, err := archive.GetMetadata(ctx, a, []byte(`{ "id": "foo" }`))
+	assert.NoError(t, err)
+	assert.Equal(t, meta, archived)
+
+	// metadata is not persisted in plaintext
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "internal.example.com")
+}
+
+func TestEncryptionPassphrase(t *testing.T) {
+	ctx := context.Background()
+	var cfg archive.Config
+	err := json.Unmarshal([]byte(`{"encryption":{"keys":[{"passphrase":"correct horse battery staple","salt":"b5d1e0c7a2f94e36"}]},"incremental":true,"inmem":{}}`), &cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	a, err := archive.New(ctx, cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`)))
+	versions, err := a.History(ctx, []byte(`{"id":"foo"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"bar"}`)}, versions)
+}
+
+func TestEncryptionInvalidConfig(t *testing.T) {
+	cases := map[string]string{
+		"no_keys":        `{"encryption":{"keys":[]},"inmem":{}}`,
+		"key_and_phrase": `{"encryption":{"keys":[{"key":"Zm9v","passphrase":"foo"}]},"inmem":{}}`,
+		"short_key":      `{"encryption":{"keys":[{"key":"Zm9v"}]},"inmem":{}}`,
+		"invalid_base64": `{"encryption":{"keys":[{"key":"!"}]},"inmem":{}}`,
+		"no_salt":        `{"encryption":{"keys":[{"passphrase":"foo"}]},"inmem":{}}`,
+		"short_salt":     `{"encryption":{"keys":[{"passphrase":"foo","salt":"bar"}]},"inmem":{}}`,
+		"key_and_salt":   `{"encryption":{"keys":[{"key":"YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE=","salt":"b5d1e0c7a2f94e36"}]},"inmem":{}}`,
+	}
+	for desc, raw := range cases {
+		t.Run(desc, func(t *testing.T) {
+			var cfg archive.Config
+			if !assert.NoError(t, json.Unmarshal([]byte(raw), &cfg)) {
+				return
+			}
+			a, err := archive.New(context.Background(), cfg)
+			assert.Nil(t, a)
+			assert.Error(t, err)
+		})
+	}
+}
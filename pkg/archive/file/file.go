@@ -0,0 +1,534 @@
+// Package file implements a resource version archive persisted to an
+// append-only JSON lines file on the local filesystem, suitable for workers
+// with a shared volume and for integration testing.
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/history"
+	archivelock "github.com/cludden/concourse-go-sdk/pkg/archive/lock"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/fatih/color"
+	"github.com/oklog/ulid/v2"
+)
+
+func init() {
+	archive.Register("file", archive.NewFactory(New))
+}
+
+// Config describes the available resource-specific configuration settings
+type Config struct {
+	// The path to the JSON lines file used to persist version history, which
+	// is created (along with any parent directories) if it does not exist. If a
+	// namespace is configured, it is inserted before the file extension (e.g.
+	// archive.<namespace>.jsonl)
+	Path string `json:"path" validate:"required"`
+}
+
+// Archive implements a resource version archive using an append-only JSON
+// lines file, where each line contains a single version along with a ULID
+// identifying when it was archived. Concurrent writers are coordinated using
+// advisory file locks, and the file is only rewritten (atomically, via a
+// temporary file) when pruning or deleting versions or replacing metadata.
+type Archive struct {
+	cfg      *Config
+	f        *os.File
+	settings *settings.Settings
+}
+
+// entry describes a single line in the archive file
+type entry struct {
+	ID       ulid.ULID          `json:"id"`
+	Metadata []history.Metadata `json:"metadata,omitempty"`
+	Version  json.RawMessage    `json:"version"`
+}
+
+func New(ctx context.Context, cfg Config, s *settings.Settings) (*Archive, error) {
+	if s.Namespace != "" {
+		ext := filepath.Ext(cfg.Path)
+		cfg.Path = strings.TrimSuffix(cfg.Path, ext) + "." + s.Namespace + ext
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0755); err != nil {
+		return nil, fmt.Errorf("error creating archive directory: %v", err)
+	}
+
+	f, err := os.OpenFile(cfg.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive file: %v", err)
+	}
+	return &Archive{cfg: &cfg, f: f, settings: s}, nil
+}
+
+func (a *Archive) Close(ctx context.Context) error {
+	if err := a.f.Close(); err != nil {
+		return fmt.Errorf("error closing archive file: %v", err)
+	}
+	return nil
+}
+
+func (a *Archive) History(ctx context.Context, latest []byte) ([][]byte, error) {
+	return history.Collect(a.HistoryIter(ctx, latest, 0))
+}
+
+// HistoryIter returns an iterator over the versions returned by History,
+// streaming entries from the archive file while holding a shared lock. The
+// page size is ignored, as entries are read one line at a time.
+func (a *Archive) HistoryIter(ctx context.Context, latest []byte, _ int) history.Seq {
+	return func(yield func([]byte, error) bool) {
+		since, ok := history.Since(latest, a.settings)
+		if !ok {
+			return
+		}
+
+		// skip entries up to and including the latest version when returning
+		// incremental history
+		var skip *[canonical.Size]byte
+		if since != nil {
+			sum, err := canonical.Hash(since)
+			if err != nil {
+				yield(nil, fmt.Errorf("error hashing latest version: %v", err))
+				return
+			}
+			skip = &sum
+		}
+
+		if err := a.acquire(false); err != nil {
+			yield(nil, fmt.Errorf("error acquiring shared lock: %v", err))
+			return
+		}
+		defer unlock(a.f)
+
+		_, err := a.scan(func(e entry) bool {
+			if skip != nil {
+				if sum, err := canonical.Hash(e.Version); err == nil && sum == *skip {
+					skip = nil
+				}
+				return true
+			}
+			return yield(e.Version, nil)
+		})
+		if err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+func (a *Archive) Put(ctx context.Context, versions ...[]byte) error {
+	return a.put(versions, nil)
+}
+
+// PutMetadata archives a version along with its metadata, rewriting the
+// archive file if the version was previously archived
+func (a *Archive) PutMetadata(ctx context.Context, version []byte, metadata []history.Metadata) error {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return fmt.Errorf("error hashing version: %v", err)
+	}
+	return a.put([][]byte{version}, map[[canonical.Size]byte][]history.Metadata{sum: metadata})
+}
+
+// Metadata returns the metadata archived alongside the given version
+func (a *Archive) Metadata(ctx context.Context, version []byte) (metadata []history.Metadata, err error) {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing version: %v", err)
+	}
+
+	if err := a.acquire(false); err != nil {
+		return nil, fmt.Errorf("error acquiring shared lock: %v", err)
+	}
+	defer unlock(a.f)
+
+	_, err = a.scan(func(e entry) bool {
+		if s, err := canonical.Hash(e.Version); err == nil && s == sum {
+			metadata = e.Metadata
+			return false
+		}
+		return true
+	})
+	return metadata, err
+}
+
+// Has returns true if the given version has been archived
+func (a *Archive) Has(ctx context.Context, version []byte) (found bool, err error) {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return false, fmt.Errorf("error hashing version: %v", err)
+	}
+
+	if err := a.acquire(false); err != nil {
+		return false, fmt.Errorf("error acquiring shared lock: %v", err)
+	}
+	defer unlock(a.f)
+
+	_, err = a.scan(func(e entry) bool {
+		if s, err := canonical.Hash(e.Version); err == nil && s == sum {
+			found = true
+			return false
+		}
+		return true
+	})
+	return found, err
+}
+
+// put archives versions that have not previously been archived, and replaces
+// the metadata of any version whose hash is present in metadata
+func (a *Archive) put(versions [][]byte, metadata map[[canonical.Size]byte][]history.Metadata) error {
+	if err := a.acquire(true); err != nil {
+		return fmt.Errorf("error acquiring exclusive lock: %v", err)
+	}
+	defer unlock(a.f)
+
+	// re-read existing entries while holding the lock to account for versions
+	// appended by concurrent writers
+	entries, complete, err := a.read()
+	if err != nil {
+		return err
+	}
+	existing := len(entries)
+	index := make(map[[canonical.Size]byte]int, len(entries)+len(versions))
+	for i, e := range entries {
+		sum, err := canonical.Hash(e.Version)
+		if err != nil {
+			return fmt.Errorf("error hashing archived version %s: %v", e.ID, err)
+		}
+		index[sum] = i
+	}
+
+	var modified bool
+	for _, version := range versions {
+		sum, err := canonical.Hash(version)
+		if err != nil {
+			return fmt.Errorf("error hashing version: %v", err)
+		}
+		meta, ok := metadata[sum]
+		if i, exists := index[sum]; exists {
+			if ok {
+				entries[i].Metadata = meta
+				modified = modified || i < existing
+			}
+			continue
+		}
+		index[sum] = len(entries)
+
+		normalized, err := canonical.Normalize(version)
+		if err != nil {
+			return fmt.Errorf("error normalizing version: %v", err)
+		}
+		entries = append(entries, entry{ID: ulid.Make(), Version: normalized, Metadata: meta})
+	}
+
+	// rewrite the file if the retention policy requires pruning or existing
+	// entries were modified, otherwise append new entries
+	retention := a.settings.Retention
+	archived := make([]time.Time, len(entries))
+	for i, e := range entries {
+		archived[i] = ulid.Time(e.ID.Time())
+	}
+	n := retention.Prune(time.Now(), archived)
+	if n > 0 && retention.DryRun {
+		pruned := make([][]byte, n)
+		for i, e := range entries[:n] {
+			pruned[i] = e.Version
+		}
+		retention.Report(pruned)
+	} else if n > 0 {
+		return a.rewrite(entries[n:])
+	}
+	if modified {
+		return a.rewrite(entries)
+	}
+	added := entries[existing:]
+	if len(added) == 0 {
+		return nil
+	}
+
+	// terminate any partial line left behind by an interrupted writer
+	var buf bytes.Buffer
+	if !complete {
+		buf.WriteByte('\n')
+	}
+	return a.write(&buf, added)
+}
+
+// List returns all versions along with the time each was archived
+func (a *Archive) List(ctx context.Context) ([]history.Entry, error) {
+	if err := a.acquire(false); err != nil {
+		return nil, fmt.Errorf("error acquiring shared lock: %v", err)
+	}
+	defer unlock(a.f)
+
+	entries, _, err := a.read()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]history.Entry, len(entries))
+	for i, e := range entries {
+		result[i] = history.Entry{Archived: ulid.Time(e.ID.Time()), Version: e.Version}
+	}
+	return result, nil
+}
+
+// Delete removes the given versions, rewriting the archive file if any
+// versions were removed
+func (a *Archive) Delete(ctx context.Context, versions ...[]byte) (int, error) {
+	remove := make(map[[canonical.Size]byte]struct{}, len(versions))
+	for _, version := range versions {
+		sum, err := canonical.Hash(version)
+		if err != nil {
+			return 0, fmt.Errorf("error hashing version: %v", err)
+		}
+		remove[sum] = struct{}{}
+	}
+
+	if err := a.acquire(true); err != nil {
+		return 0, fmt.Errorf("error acquiring exclusive lock: %v", err)
+	}
+	defer unlock(a.f)
+
+	entries, _, err := a.read()
+	if err != nil {
+		return 0, err
+	}
+	kept := make([]entry, 0, len(entries))
+	for _, e := range entries {
+		sum, err := canonical.Hash(e.Version)
+		if err != nil {
+			return 0, fmt.Errorf("error hashing archived version %s: %v", e.ID, err)
+		}
+		if _, ok := remove[sum]; !ok {
+			kept = append(kept, e)
+		}
+	}
+	n := len(entries) - len(kept)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, a.rewrite(kept)
+}
+
+// lockOwner describes the contents of the lock file, identifying the current
+// holder of the archive lock
+type lockOwner struct {
+	Acquired time.Time `json:"acquired"`
+	Owner    string    `json:"owner"`
+}
+
+// lease describes an archive lock held via an exclusive advisory lock on the
+// lock file
+type lease struct {
+	f *os.File
+}
+
+// TryLock attempts to acquire an exclusive advisory lock on a lock file
+// alongside the archive file (e.g. archive.jsonl.lock), which is held until
+// released. Advisory locks are released automatically when the holding
+// process exits, so leases never expire and are never stolen.
+func (a *Archive) TryLock(ctx context.Context, req archivelock.Request) (archivelock.Lease, error) {
+	f, err := os.OpenFile(a.cfg.Path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file: %v", err)
+	}
+	ok, err := tryLock(f)
+	if err != nil || !ok {
+		defer f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error locking lock file: %v", err)
+		}
+		var holder lockOwner
+		json.NewDecoder(f).Decode(&holder)
+		return nil, &archivelock.HeldError{Owner: holder.Owner}
+	}
+
+	// replace any contents left behind by a holder that exited without
+	// releasing the lock
+	b, err := json.Marshal(lockOwner{Acquired: time.Now().UTC(), Owner: req.Owner})
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.Write(b)
+	}
+	if err != nil {
+		unlock(f)
+		f.Close()
+		return nil, fmt.Errorf("error writing lock file: %v", err)
+	}
+	return &lease{f: f}, nil
+}
+
+// Release clears the lock file and releases the advisory lock
+func (l *lease) Release(ctx context.Context) error {
+	defer l.f.Close()
+	if err := l.f.Truncate(0); err != nil {
+		unlock(l.f)
+		return fmt.Errorf("error truncating lock file: %v", err)
+	}
+	if err := unlock(l.f); err != nil {
+		return fmt.Errorf("error releasing lock file: %v", err)
+	}
+	return nil
+}
+
+// acquire locks the archive file, reopening it if it was replaced by a
+// concurrent rewrite while waiting for the lock, so that the lock is always
+// held on the current archive file
+func (a *Archive) acquire(exclusive bool) error {
+	for {
+		if err := lock(a.f, exclusive); err != nil {
+			return err
+		}
+		info, err := a.f.Stat()
+		if err != nil {
+			unlock(a.f)
+			return fmt.Errorf("error reading archive file info: %v", err)
+		}
+		if current, err := os.Stat(a.cfg.Path); err == nil && os.SameFile(info, current) {
+			return nil
+		}
+
+		unlock(a.f)
+		f, err := os.OpenFile(a.cfg.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("error reopening archive file: %v", err)
+		}
+		a.f.Close()
+		a.f = f
+	}
+}
+
+// rewrite atomically replaces the archive file with one containing the given
+// entries, by writing a temporary file in the same directory and renaming it
+// over the archive file, which requires the caller to hold an exclusive lock.
+// Concurrent writers waiting on the lock reopen the replaced file once the
+// lock is released.
+func (a *Archive) rewrite(entries []entry) (err error) {
+	dir := filepath.Dir(a.cfg.Path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(a.cfg.Path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary archive file: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	var buf bytes.Buffer
+	if err := encode(&buf, entries); err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("error writing temporary archive file: %v", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return fmt.Errorf("error setting temporary archive file permissions: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("error syncing temporary archive file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary archive file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), a.cfg.Path); err != nil {
+		return fmt.Errorf("error replacing archive file: %v", err)
+	}
+
+	// persist the rename, which is best effort as not every platform supports
+	// syncing directories
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// write appends the given entries to the archive file, preceded by any data
+// already present in buf
+func (a *Archive) write(buf *bytes.Buffer, entries []entry) error {
+	if err := encode(buf, entries); err != nil {
+		return err
+	}
+	if _, err := a.f.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("error writing archive file: %v", err)
+	}
+	if err := a.f.Sync(); err != nil {
+		return fmt.Errorf("error syncing archive file: %v", err)
+	}
+	return nil
+}
+
+// encode appends the given entries to buf as json lines
+func encode(buf *bytes.Buffer, entries []entry) error {
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("error serializing version: %v", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return nil
+}
+
+// read parses all entries in the archive file, ignoring any corrupt lines
+// left behind by an interrupted writer. It also reports whether the file is
+// empty or terminated by a newline.
+func (a *Archive) read() (entries []entry, complete bool, err error) {
+	complete, err = a.scan(func(e entry) bool {
+		entries = append(entries, e)
+		return true
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return entries, complete, nil
+}
+
+// scan invokes fn with each entry in the archive file, in order, until fn
+// returns false, ignoring any corrupt lines left behind by an interrupted
+// writer. It also reports whether the file is empty or terminated by a
+// newline.
+func (a *Archive) scan(fn func(entry) bool) (complete bool, err error) {
+	if _, err := a.f.Seek(0, io.SeekStart); err != nil {
+		return false, fmt.Errorf("error reading archive file: %v", err)
+	}
+
+	r := bufio.NewReader(a.f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return len(line) == 0, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("error reading archive file: %v", err)
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var e entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			color.Yellow("skipping corrupt archive file line %d: %v", n, err)
+			continue
+		}
+		if !fn(e) {
+			return false, nil
+		}
+	}
+}
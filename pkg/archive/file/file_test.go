@@ -0,0 +1,225 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive/internal/archivetest"
+	archivelock "github.com/cludden/concourse-go-sdk/pkg/archive/lock"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchive(t *testing.T) {
+	archivetest.Run(t, func(t *testing.T) archivetest.Opener {
+		cfg := Config{
+			Path: filepath.Join(t.TempDir(), "my-team", "my-pipeline", "my-resource.jsonl"),
+		}
+		return func(s *settings.Settings) (archivetest.Archive, error) {
+			return New(context.Background(), cfg, s)
+		}
+	})
+}
+
+func TestArchiveInterruptedWriter(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{Path: filepath.Join(t.TempDir(), "archive.jsonl")}
+
+	a, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"foo"}`)))
+	assert.NoError(t, a.Close(ctx))
+
+	// simulate an interrupted writer
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND, 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.WriteString(`{"id":"01GQ`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	// the incomplete entry is ignored by subsequent writers
+	a, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, a.Close(ctx))
+	}()
+	assert.NoError(t, a.Put(ctx, []byte(`{ "id": "foo" }`), []byte(`{"id":"z"}`)))
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`), []byte(`{"id":"z"}`)}, versions)
+}
+
+func TestArchiveConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{Path: filepath.Join(t.TempDir(), "archive.jsonl")}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a, err := New(ctx, cfg, &settings.Settings{})
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer a.Close(ctx)
+			for j := 0; j < 10; j++ {
+				assert.NoError(t, a.Put(ctx,
+					[]byte(`{"id":"shared"}`),
+					[]byte(fmt.Sprintf(`{"id":"%d-%d"}`, i, j)),
+				))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	a, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close(ctx)
+
+	history, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Len(t, history, 101)
+}
+
+func TestArchiveRetention(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{
+		Path: filepath.Join(t.TempDir(), "my-resource.jsonl"),
+	}
+
+	// seed archive with versions archived a week ago
+	old := time.Now().Add(-7 * 24 * time.Hour)
+	var seed []byte
+	for _, id := range []string{"a", "b", "c"} {
+		line, err := json.Marshal(entry{
+			ID:      ulid.MustNew(ulid.Timestamp(old), ulid.DefaultEntropy()),
+			Version: json.RawMessage(fmt.Sprintf(`{"id":%q}`, id)),
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		seed = append(append(seed, line...), '\n')
+	}
+	if !assert.NoError(t, os.WriteFile(cfg.Path, seed, 0644)) {
+		return
+	}
+
+	retention := &settings.Retention{
+		DryRun:   true,
+		KeepLast: 2,
+		MaxAge:   settings.Duration(24 * time.Hour),
+	}
+	a, err := New(ctx, cfg, &settings.Settings{Retention: retention})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close(ctx)
+
+	// dry run should not prune any versions
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"d"}`)))
+	history, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Len(t, history, 4)
+
+	// expired versions are pruned, retaining the last 2 versions
+	retention.DryRun = false
+	assert.NoError(t, a.Put(ctx))
+	history, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"id":"c"}`),
+		[]byte(`{"id":"d"}`),
+	}, history)
+
+	// subsequent writes append to the rewritten file
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"e"}`)))
+	history, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"id":"d"}`),
+		[]byte(`{"id":"e"}`),
+	}, history)
+}
+
+func TestArchiveLock(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	a, err := New(ctx, Config{Path: path}, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close(ctx)
+	b, err := New(ctx, Config{Path: path}, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer b.Close(ctx)
+
+	lease, err := a.TryLock(ctx, archivelock.Request{Owner: "foo", TTL: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// contending archives report the current holder, and the lock never
+	// expires while held
+	_, err = b.TryLock(ctx, archivelock.Request{Owner: "bar", Steal: true, TTL: time.Minute})
+	assert.Equal(t, &archivelock.HeldError{Owner: "foo"}, err)
+
+	// archive operations are not blocked by the archive lock
+	assert.NoError(t, b.Put(ctx, []byte(`{"id":"foo"}`)))
+
+	assert.NoError(t, lease.Release(ctx))
+	lease, err = b.TryLock(ctx, archivelock.Request{Owner: "bar", TTL: time.Minute})
+	if assert.NoError(t, err) {
+		assert.NoError(t, lease.Release(ctx))
+	}
+}
+
+func TestArchiveRewrite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "archive.jsonl")
+	a, err := New(ctx, Config{Path: path}, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close(ctx)
+	b, err := New(ctx, Config{Path: path}, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer b.Close(ctx)
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`)))
+
+	// rewrites replace the archive file without leaving temporary files behind
+	n, err := a.Delete(ctx, []byte(`{"id":"foo"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path}, files)
+
+	// archives opened before the rewrite follow the replaced file
+	assert.NoError(t, b.Put(ctx, []byte(`{"id":"baz"}`)))
+	for _, archive := range []*Archive{a, b} {
+		versions, err := archive.History(ctx, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte(`{"id":"bar"}`), []byte(`{"id":"baz"}`)}, versions)
+	}
+}
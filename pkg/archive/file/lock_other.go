@@ -0,0 +1,22 @@
+//go:build !unix && !windows
+
+package file
+
+import (
+	"os"
+)
+
+// lock is a noop on platforms without file locking support
+func lock(f *os.File, exclusive bool) error {
+	return nil
+}
+
+// unlock is a noop on platforms without file locking support
+func unlock(f *os.File) error {
+	return nil
+}
+
+// tryLock always succeeds on platforms without file locking support
+func tryLock(f *os.File) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,77 @@
+// Package history provides primitives for streaming archived version history.
+package history
+
+import (
+	"time"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+)
+
+// Entry describes an archived version along with the time it was archived,
+// which is zero if unknown
+type Entry struct {
+	Archived time.Time
+	Version  []byte
+}
+
+// Metadata describes a single name/value pair of resource metadata archived
+// alongside a version
+type Metadata struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Seq is an iterator over archived versions, ordered oldest first. It mirrors
+// the shape of iter.Seq2[[]byte, error], yielding either a version or an
+// error, and stops after the first error or when yield returns false.
+type Seq func(yield func(version []byte, err error) bool)
+
+// Since applies the common history settings to the latest version reported by
+// concourse, returning false if no versions should be returned because
+// concourse already has version history and neither force_history nor
+// incremental history is enabled. Otherwise, it returns the version after
+// which archived versions should be returned, or nil if the full history
+// should be returned.
+func Since(latest []byte, s *settings.Settings) (since []byte, ok bool) {
+	if latest == nil || s.ForceHistory {
+		return nil, true
+	}
+	if !s.Incremental {
+		return nil, false
+	}
+	return latest, true
+}
+
+// Collect reads all versions from the given iterator into memory
+func Collect(seq Seq) (versions [][]byte, err error) {
+	seq(func(version []byte, e error) bool {
+		if e != nil {
+			err = e
+			return false
+		}
+		versions = append(versions, version)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// Error returns an iterator that yields a single error
+func Error(err error) Seq {
+	return func(yield func([]byte, error) bool) {
+		yield(nil, err)
+	}
+}
+
+// Slice returns an iterator over the given versions
+func Slice(versions [][]byte) Seq {
+	return func(yield func([]byte, error) bool) {
+		for _, version := range versions {
+			if !yield(version, nil) {
+				return
+			}
+		}
+	}
+}
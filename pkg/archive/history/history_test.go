@@ -0,0 +1,58 @@
+package history
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollect(t *testing.T) {
+	versions := [][]byte{[]byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`)}
+
+	collected, err := Collect(Slice(versions))
+	assert.NoError(t, err)
+	assert.Equal(t, versions, collected)
+
+	collected, err = Collect(Slice(nil))
+	assert.NoError(t, err)
+	assert.Len(t, collected, 0)
+
+	collected, err = Collect(Error(errors.New("boom")))
+	assert.EqualError(t, err, "boom")
+	assert.Nil(t, collected)
+}
+
+func TestSliceStop(t *testing.T) {
+	var seen int
+	Slice([][]byte{[]byte(`1`), []byte(`2`), []byte(`3`)})(func([]byte, error) bool {
+		seen++
+		return seen < 2
+	})
+	assert.Equal(t, 2, seen)
+}
+
+func TestSince(t *testing.T) {
+	latest := []byte(`{"id":"foo"}`)
+	cases := map[string]struct {
+		latest   []byte
+		settings settings.Settings
+		since    []byte
+		ok       bool
+	}{
+		"no latest version":  {ok: true},
+		"latest version":     {latest: latest},
+		"force history":      {latest: latest, settings: settings.Settings{ForceHistory: true}, ok: true},
+		"incremental":        {latest: latest, settings: settings.Settings{Incremental: true}, since: latest, ok: true},
+		"incremental, empty": {settings: settings.Settings{Incremental: true}, ok: true},
+	}
+
+	for desc, c := range cases {
+		t.Run(desc, func(t *testing.T) {
+			since, ok := Since(c.latest, &c.settings)
+			assert.Equal(t, c.since, since)
+			assert.Equal(t, c.ok, ok)
+		})
+	}
+}
@@ -2,7 +2,11 @@ package inmem
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/history"
 	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
 )
 
@@ -14,26 +18,174 @@ type Config struct {
 // Archive implements an in-mmeory archive backend, that provides no useful utility
 // beyond testing archive behavior. DO NOT USE in production.
 type Archive struct {
-	history [][]byte
+	archived []time.Time
+	history  [][]byte
+	index    map[[canonical.Size]byte]struct{}
+	metadata map[[canonical.Size]byte][]history.Metadata
+	settings *settings.Settings
 }
 
 func New(ctx context.Context, cfg Config, s *settings.Settings) (*Archive, error) {
-	history := make([][]byte, len(cfg.History))
-	for i, raw := range cfg.History {
-		history[i] = []byte(raw)
+	a := &Archive{
+		index:    make(map[[canonical.Size]byte]struct{}, len(cfg.History)),
+		metadata: make(map[[canonical.Size]byte][]history.Metadata),
+		settings: s,
 	}
-	return &Archive{history: history}, nil
+	for _, raw := range cfg.History {
+		sum, err := canonical.Hash([]byte(raw))
+		if err != nil {
+			return nil, fmt.Errorf("invalid history: %v", err)
+		}
+		if _, ok := a.index[sum]; ok {
+			continue
+		}
+		a.archived = append(a.archived, time.Time{})
+		a.history = append(a.history, []byte(raw))
+		a.index[sum] = struct{}{}
+	}
+	return a, nil
 }
 
 func (a *Archive) Close(context.Context) error {
 	return nil
 }
 
-func (a *Archive) History(context.Context, []byte) ([][]byte, error) {
-	return a.history, nil
+func (a *Archive) History(ctx context.Context, latest []byte) ([][]byte, error) {
+	return history.Collect(a.HistoryIter(ctx, latest, 0))
+}
+
+// HistoryIter returns an iterator over the versions returned by History
+func (a *Archive) HistoryIter(ctx context.Context, latest []byte, _ int) history.Seq {
+	if latest == nil || !a.settings.Incremental {
+		return history.Slice(a.history)
+	}
+
+	sum, err := canonical.Hash(latest)
+	if err != nil {
+		return history.Error(fmt.Errorf("error hashing latest version: %v", err))
+	}
+	for i, version := range a.history {
+		if s, err := canonical.Hash(version); err == nil && s == sum {
+			return history.Slice(a.history[i+1:])
+		}
+	}
+	return history.Slice(nil)
 }
 
 func (a *Archive) Put(ctx context.Context, versions ...[]byte) error {
-	a.history = append(a.history, versions...)
+	for _, version := range versions {
+		sum, err := canonical.Hash(version)
+		if err != nil {
+			return fmt.Errorf("error hashing version: %v", err)
+		}
+		if _, ok := a.index[sum]; ok {
+			continue
+		}
+		a.archived = append(a.archived, time.Now())
+		a.history = append(a.history, version)
+		a.index[sum] = struct{}{}
+	}
+	return a.prune()
+}
+
+// PutMetadata archives a version along with its metadata
+func (a *Archive) PutMetadata(ctx context.Context, version []byte, metadata []history.Metadata) error {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return fmt.Errorf("error hashing version: %v", err)
+	}
+	a.metadata[sum] = metadata
+	if err := a.Put(ctx, version); err != nil {
+		return err
+	}
+	if _, ok := a.index[sum]; !ok {
+		delete(a.metadata, sum)
+	}
+	return nil
+}
+
+// Metadata returns the metadata archived alongside the given version
+func (a *Archive) Metadata(ctx context.Context, version []byte) ([]history.Metadata, error) {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing version: %v", err)
+	}
+	return a.metadata[sum], nil
+}
+
+// List returns all versions along with the time each was archived, which is
+// zero for versions provided via config
+// Has returns true if the given version has been archived
+func (a *Archive) Has(ctx context.Context, version []byte) (bool, error) {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return false, fmt.Errorf("error hashing version: %v", err)
+	}
+	_, ok := a.index[sum]
+	return ok, nil
+}
+
+func (a *Archive) List(ctx context.Context) ([]history.Entry, error) {
+	entries := make([]history.Entry, len(a.history))
+	for i, version := range a.history {
+		entries[i] = history.Entry{Archived: a.archived[i], Version: version}
+	}
+	return entries, nil
+}
+
+// Delete removes the given versions
+func (a *Archive) Delete(ctx context.Context, versions ...[]byte) (int, error) {
+	remove := make(map[[canonical.Size]byte]struct{}, len(versions))
+	for _, version := range versions {
+		sum, err := canonical.Hash(version)
+		if err != nil {
+			return 0, fmt.Errorf("error hashing version: %v", err)
+		}
+		remove[sum] = struct{}{}
+	}
+
+	var archived []time.Time
+	var kept [][]byte
+	for i, version := range a.history {
+		sum, err := canonical.Hash(version)
+		if err != nil {
+			return 0, fmt.Errorf("error hashing version: %v", err)
+		}
+		if _, ok := remove[sum]; ok {
+			delete(a.index, sum)
+			delete(a.metadata, sum)
+			continue
+		}
+		archived = append(archived, a.archived[i])
+		kept = append(kept, version)
+	}
+	n := len(a.history) - len(kept)
+	a.archived, a.history = archived, kept
+	return n, nil
+}
+
+// prune removes the oldest versions according to the configured retention
+// policy
+func (a *Archive) prune() error {
+	retention := a.settings.Retention
+	n := retention.Prune(time.Now(), a.archived)
+	if n == 0 {
+		return nil
+	}
+	if retention.DryRun {
+		retention.Report(a.history[:n])
+		return nil
+	}
+
+	for _, version := range a.history[:n] {
+		sum, err := canonical.Hash(version)
+		if err != nil {
+			return fmt.Errorf("error hashing version: %v", err)
+		}
+		delete(a.index, sum)
+		delete(a.metadata, sum)
+	}
+	a.archived = a.archived[n:]
+	a.history = a.history[n:]
 	return nil
 }
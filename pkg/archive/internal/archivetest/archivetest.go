@@ -0,0 +1,251 @@
+// Package archivetest provides a conformance test suite shared by the
+// built-in archive backends.
+package archivetest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive/history"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/stretchr/testify/assert"
+)
+
+// Archive describes the backend methods exercised by the suite
+type Archive interface {
+	Close(ctx context.Context) error
+	Delete(ctx context.Context, versions ...[]byte) (int, error)
+	History(ctx context.Context, latest []byte) ([][]byte, error)
+	HistoryIter(ctx context.Context, latest []byte, pageSize int) history.Seq
+	List(ctx context.Context) ([]history.Entry, error)
+	Metadata(ctx context.Context, version []byte) ([]history.Metadata, error)
+	Put(ctx context.Context, versions ...[]byte) error
+	PutMetadata(ctx context.Context, version []byte, metadata []history.Metadata) error
+}
+
+// Opener opens an archive backed by the storage provisioned for a single
+// test, using the given settings
+type Opener func(s *settings.Settings) (Archive, error)
+
+// Run runs the conformance suite, invoking storage once per test to provision
+// empty storage. Changes are expected to be visible to archives opened after
+// the archive that made them is closed.
+func Run(t *testing.T, storage func(t *testing.T) Opener) {
+	t.Run("History", func(t *testing.T) {
+		testHistory(t, storage(t))
+	})
+	t.Run("ListDelete", func(t *testing.T) {
+		testListDelete(t, storage(t))
+	})
+	t.Run("Metadata", func(t *testing.T) {
+		testMetadata(t, storage(t))
+	})
+	t.Run("Namespace", func(t *testing.T) {
+		testNamespace(t, storage(t))
+	})
+}
+
+// open opens an archive, failing the test immediately on error
+func open(t *testing.T, opener Opener, s *settings.Settings) Archive {
+	t.Helper()
+	a, err := opener(s)
+	if err != nil {
+		t.Fatalf("error opening archive: %v", err)
+	}
+	return a
+}
+
+func testHistory(t *testing.T, opener Opener) {
+	ctx := context.Background()
+	s := &settings.Settings{}
+	a := open(t, opener, s)
+
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 0)
+
+	history := [][]byte{
+		[]byte(`{"id":"foo"}`),
+		[]byte(`{"id":"bar"}`),
+		[]byte(`{"id":"baz"}`),
+	}
+	if !assert.NoError(t, a.Put(ctx, history...)) {
+		return
+	}
+
+	// no versions are returned with a latest version, no force history
+	versions, err = a.History(ctx, []byte(`{"id":"baz"}`))
+	assert.NoError(t, err)
+	assert.Len(t, versions, 0)
+
+	// all versions are returned in order with no latest version
+	versions, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, history, versions)
+
+	// all versions are returned in order with a latest version, force history
+	s.ForceHistory = true
+	versions, err = a.History(ctx, []byte(`{"id":"baz"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, history, versions)
+
+	// versions archived after the latest version are returned, incremental
+	// history
+	s.ForceHistory = false
+	s.Incremental = true
+	versions, err = a.History(ctx, []byte(`{ "id": "foo" }`))
+	assert.NoError(t, err)
+	assert.Equal(t, history[1:], versions)
+
+	// no versions are returned for a latest version that has not been
+	// archived, incremental history
+	versions, err = a.History(ctx, []byte(`{"id":"qux"}`))
+	assert.NoError(t, err)
+	assert.Len(t, versions, 0)
+	if !assert.NoError(t, a.Close(ctx)) {
+		return
+	}
+
+	// previously archived versions are de-duplicated, and new versions are
+	// appended in order
+	a = open(t, opener, &settings.Settings{})
+	defer func() {
+		assert.NoError(t, a.Close(ctx))
+	}()
+	assert.NoError(t, a.Put(ctx,
+		[]byte(`{ "id": "foo" }`),
+		[]byte(`{"id":"z"}`),
+		[]byte(`{"id":"x"}`),
+		[]byte(`{"id":"x"}`),
+		[]byte(`{"id":"A"}`),
+	))
+	versions, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"id":"foo"}`),
+		[]byte(`{"id":"bar"}`),
+		[]byte(`{"id":"baz"}`),
+		[]byte(`{"id":"z"}`),
+		[]byte(`{"id":"x"}`),
+		[]byte(`{"id":"A"}`),
+	}, versions)
+
+	// versions are streamed in pages, stopping early
+	var streamed [][]byte
+	a.HistoryIter(ctx, nil, 1)(func(v []byte, err error) bool {
+		assert.NoError(t, err)
+		streamed = append(streamed, v)
+		return len(streamed) < 4
+	})
+	assert.Equal(t, versions[:4], streamed)
+}
+
+func testListDelete(t *testing.T, opener Opener) {
+	ctx := context.Background()
+	a := open(t, opener, &settings.Settings{})
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`), []byte(`{"id":"baz"}`)))
+	if !assert.NoError(t, a.Close(ctx)) {
+		return
+	}
+
+	// list versions along with the time each was archived
+	a = open(t, opener, &settings.Settings{})
+	entries, err := a.List(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 3) {
+		for i, id := range []string{"foo", "bar", "baz"} {
+			assert.JSONEq(t, fmt.Sprintf(`{"id":%q}`, id), string(entries[i].Version))
+			assert.WithinDuration(t, time.Now(), entries[i].Archived, time.Minute)
+		}
+	}
+
+	// delete versions, ignoring versions that have not been archived
+	n, err := a.Delete(ctx, []byte(`{ "id": "bar" }`), []byte(`{"id":"qux"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	if !assert.NoError(t, a.Close(ctx)) {
+		return
+	}
+
+	a = open(t, opener, &settings.Settings{})
+	defer func() {
+		assert.NoError(t, a.Close(ctx))
+	}()
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`), []byte(`{"id":"baz"}`)}, versions)
+
+	// deleted versions can be archived again
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"bar"}`)))
+	versions, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`), []byte(`{"id":"baz"}`), []byte(`{"id":"bar"}`)}, versions)
+}
+
+func testMetadata(t *testing.T, opener Opener) {
+	ctx := context.Background()
+	a := open(t, opener, &settings.Settings{})
+	foo, bar := []byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`)
+	assert.NoError(t, a.Put(ctx, foo))
+
+	// archive metadata alongside a new version
+	meta := []history.Metadata{{Name: "commit", Value: "abc123"}}
+	assert.NoError(t, a.PutMetadata(ctx, bar, meta))
+	archived, err := a.Metadata(ctx, []byte(`{ "id": "bar" }`))
+	assert.NoError(t, err)
+	assert.Equal(t, meta, archived)
+
+	// versions archived without metadata have none
+	archived, err = a.Metadata(ctx, foo)
+	assert.NoError(t, err)
+	assert.Nil(t, archived)
+
+	// replace the metadata of a previously archived version
+	replaced := []history.Metadata{{Name: "commit", Value: "def456"}, {Name: "author", Value: "jane"}}
+	assert.NoError(t, a.PutMetadata(ctx, foo, replaced))
+	if !assert.NoError(t, a.Close(ctx)) {
+		return
+	}
+
+	// metadata is persisted without affecting version order
+	a = open(t, opener, &settings.Settings{})
+	defer func() {
+		assert.NoError(t, a.Close(ctx))
+	}()
+	archived, err = a.Metadata(ctx, foo)
+	assert.NoError(t, err)
+	assert.Equal(t, replaced, archived)
+	archived, err = a.Metadata(ctx, bar)
+	assert.NoError(t, err)
+	assert.Equal(t, meta, archived)
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{foo, bar}, versions)
+
+	// deleting a version removes its metadata
+	_, err = a.Delete(ctx, foo)
+	assert.NoError(t, err)
+	archived, err = a.Metadata(ctx, foo)
+	assert.NoError(t, err)
+	assert.Nil(t, archived)
+}
+
+func testNamespace(t *testing.T, opener Opener) {
+	ctx := context.Background()
+	for _, ns := range []string{"", "foo", "bar"} {
+		a := open(t, opener, &settings.Settings{Namespace: ns})
+		assert.NoError(t, a.Put(ctx, []byte(fmt.Sprintf(`{"ns":%q}`, ns))))
+		assert.NoError(t, a.Close(ctx))
+	}
+
+	// each namespace contains only its own history
+	for _, ns := range []string{"", "foo", "bar"} {
+		a := open(t, opener, &settings.Settings{Namespace: ns})
+		versions, err := a.History(ctx, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte(fmt.Sprintf(`{"ns":%q}`, ns))}, versions, ns)
+		assert.NoError(t, a.Close(ctx))
+	}
+}
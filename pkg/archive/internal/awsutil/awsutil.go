@@ -0,0 +1,132 @@
+// Package awsutil provides AWS client configuration, conditional write
+// helpers, and lease-based locking shared by S3 backed archive implementations
+package awsutil
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+)
+
+type (
+	// Config describes the settings used to initialize an AWS client
+	Config struct {
+		// Optional role assumed using the resolved base credentials
+		AssumeRole *AssumeRole
+		// Optional PEM encoded CA certificate bundle used to verify the endpoint
+		CABundle string
+		// Optional static base credentials
+		Credentials *Credentials
+		// Optional custom endpoint
+		Endpoint string
+		// Optional named profile from the shared config and credentials files
+		Profile string
+		// The AWS region
+		Region string
+		// Optional web identity used to assume a role
+		WebIdentity *WebIdentity
+	}
+
+	// AssumeRole describes an IAM role assumed using the base credentials
+	AssumeRole struct {
+		// The duration of the role session (default: 15m)
+		Duration settings.Duration `json:"duration" validate:"min=0"`
+		// The external ID required by the role's trust policy, if any
+		ExternalID string `json:"external_id"`
+		// The ARN of the role to assume
+		RoleARN string `json:"role_arn" validate:"required"`
+		// The role session name (default: generated)
+		SessionName string `json:"session_name"`
+	}
+
+	// Credentials describes AWS session credentials used for authenticating with S3
+	Credentials struct {
+		// The AWS_ACCESS_KEY_ID value to use for authenticating with S3
+		AccessKey string `json:"access_key" validate:"required"`
+		// The AWS_SECRET_ACCESS_KEY value to use for authenticating with S3
+		SecretKey string `json:"secret_key" validate:"required"`
+		// The AWS_SESSION_TOKEN value to use for authenticating with S3
+		SessionToken string `json:"session_token"`
+	}
+
+	// WebIdentity describes an IAM role assumed using an OIDC web identity token
+	WebIdentity struct {
+		// The ARN of the role to assume
+		RoleARN string `json:"role_arn" validate:"required"`
+		// The role session name (default: generated)
+		SessionName string `json:"session_name"`
+		// The path to a file containing the web identity token, which is re-read
+		// whenever credentials are refreshed
+		TokenFile string `json:"token_file" validate:"required"`
+	}
+)
+
+// LoadConfig resolves an aws.Config from the given settings, layering web
+// identity or assumed role credentials on top of the static, profile, or
+// default base credentials
+func LoadConfig(ctx context.Context, c Config) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{
+		config.WithRegion(c.Region),
+	}
+	if c.Credentials != nil {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(c.Credentials.AccessKey, c.Credentials.SecretKey, c.Credentials.SessionToken)))
+	}
+	if c.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(c.Profile))
+	}
+	if c.CABundle != "" {
+		opts = append(opts, config.WithCustomCABundle(strings.NewReader(c.CABundle)))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return cfg, fmt.Errorf("error initializing aws session: %v", err)
+	}
+
+	switch {
+	case c.WebIdentity != nil:
+		provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(cfg), c.WebIdentity.RoleARN, stscreds.IdentityTokenFile(c.WebIdentity.TokenFile), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = c.WebIdentity.SessionName
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	case c.AssumeRole != nil:
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), c.AssumeRole.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.Duration = time.Duration(c.AssumeRole.Duration)
+			o.RoleSessionName = c.AssumeRole.SessionName
+			if c.AssumeRole.ExternalID != "" {
+				o.ExternalID = aws.String(c.AssumeRole.ExternalID)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	return cfg, nil
+}
+
+// NewS3Client initializes an s3 client from the given settings, using path
+// style addressing when a custom endpoint is specified
+func NewS3Client(ctx context.Context, c Config) (*s3.Client, error) {
+	cfg, err := LoadConfig(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var s3opts []func(*s3.Options)
+	if c.Endpoint != "" {
+		s3opts = append(s3opts,
+			s3.WithEndpointResolver(s3.EndpointResolverFromURL(c.Endpoint)),
+			func(o *s3.Options) {
+				o.UsePathStyle = true
+			},
+		)
+	}
+	return s3.NewFromConfig(cfg, s3opts...), nil
+}
@@ -0,0 +1,275 @@
+package awsutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/lock"
+	"github.com/fatih/color"
+)
+
+// lockAttempts limits the number of conditional writes attempted by TryLock
+// when the lock object is concurrently released or stolen
+const lockAttempts = 3
+
+// Lock implements a lease-based archive lock using a lock object, which is
+// created and replaced using conditional writes
+type Lock struct {
+	// The bucket containing the lock object
+	Bucket string
+	// The s3 client used to manage the lock object
+	Client *s3.Client
+	// The object key of the lock object
+	Key string
+}
+
+// lockState describes the contents of the lock object
+type lockState struct {
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+	Owner    string    `json:"owner"`
+}
+
+// Lease describes an archive lock held via the lock object, which is renewed
+// in the background until released
+type Lease struct {
+	l     *Lock
+	owner string
+	state lockState
+	ttl   time.Duration
+
+	mu   sync.Mutex
+	etag string
+	lost error
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// TryLock attempts to acquire the lock by conditionally creating the lock
+// object, which records the owner and expiry of the lease. An expired lease
+// is stolen, if permitted, by conditionally replacing the lock object, with
+// expiry evaluated using the local clock. The acquired lease is renewed every
+// third of its TTL until released, so that the lock is never stolen from a
+// live holder.
+func (l *Lock) TryLock(ctx context.Context, req lock.Request) (*Lease, error) {
+	var held *lock.HeldError
+	for attempt := 0; attempt < lockAttempts; attempt++ {
+		now := time.Now().UTC()
+		acquired := lockState{Acquired: now, Expires: now.Add(req.TTL), Owner: req.Owner}
+		b, err := json.Marshal(acquired)
+		if err != nil {
+			return nil, fmt.Errorf("error serializing lock object: %v", err)
+		}
+		input := &s3.PutObjectInput{
+			Bucket:      &l.Bucket,
+			Key:         &l.Key,
+			Body:        bytes.NewReader(b),
+			ContentType: aws.String("application/json"),
+		}
+
+		// create the lock object if it does not exist
+		resp, err := l.Client.PutObject(ctx, input, s3.WithAPIOptions(smithyhttp.SetHeaderValue("If-None-Match", "*")))
+		if err == nil {
+			return l.lease(acquired, req.TTL, aws.ToString(resp.ETag)), nil
+		}
+		if !IsConflict(err) {
+			return nil, fmt.Errorf("error creating lock object %s: %v", l.Key, err)
+		}
+
+		// inspect the current lease, retrying if it was released concurrently
+		state, etag, err := l.state(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if state == nil {
+			continue
+		}
+		held = &lock.HeldError{Owner: state.Owner, Expires: state.Expires}
+		if !req.Steal || now.Before(state.Expires) {
+			return nil, held
+		}
+
+		// replace the expired lease, unless it was concurrently modified
+		input.Body = bytes.NewReader(b)
+		resp, err = l.Client.PutObject(ctx, input, s3.WithAPIOptions(smithyhttp.SetHeaderValue("If-Match", etag)))
+		if err == nil {
+			color.Yellow("stole expired archive lock held by %s, which expired at %s", state.Owner, state.Expires.Format(time.RFC3339))
+			return l.lease(acquired, req.TTL, aws.ToString(resp.ETag)), nil
+		}
+		if !IsConflict(err) {
+			return nil, fmt.Errorf("error replacing expired lock object %s: %v", l.Key, err)
+		}
+	}
+	if held == nil {
+		held = &lock.HeldError{}
+	}
+	return nil, held
+}
+
+// lease returns a Lease for a newly written lock object, renewing it in the
+// background if the lease expires
+func (l *Lock) lease(state lockState, ttl time.Duration, etag string) *Lease {
+	ctx, cancel := context.WithCancel(context.Background())
+	lease := &Lease{l: l, owner: state.Owner, state: state, ttl: ttl, etag: etag, cancel: cancel, done: make(chan struct{})}
+	go lease.heartbeat(ctx)
+	return lease
+}
+
+// heartbeat renews the lease every third of its TTL until the lease is
+// released or lost. Leases with a non-positive TTL are never renewed.
+func (l *Lease) heartbeat(ctx context.Context) {
+	defer close(l.done)
+	if l.ttl <= 0 {
+		return
+	}
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.renew(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				color.Yellow("error renewing archive lock: %v", err)
+				l.mu.Lock()
+				lost := l.lost != nil
+				l.mu.Unlock()
+				if lost {
+					return
+				}
+			}
+		}
+	}
+}
+
+// renew extends the lease by conditionally replacing the lock object, marking
+// the lease lost if the lock object was replaced or removed by another owner
+func (l *Lease) renew(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state := l.state
+	state.Expires = time.Now().UTC().Add(l.ttl)
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error serializing lock object: %v", err)
+	}
+	resp, err := l.l.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &l.l.Bucket,
+		Key:         &l.l.Key,
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	}, s3.WithAPIOptions(smithyhttp.SetHeaderValue("If-Match", l.etag)))
+	if IsConflict(err) {
+		l.lost = errors.New("lease expired and was stolen")
+		return l.lost
+	}
+	if err != nil {
+		return fmt.Errorf("error replacing lock object %s: %v", l.l.Key, err)
+	}
+	l.etag, l.state = aws.ToString(resp.ETag), state
+	return nil
+}
+
+// Held returns an error if the lease is no longer held, because it expired
+// and was stolen by another owner, which is confirmed by comparing the
+// current lock object with the one last written by this lease
+func (l *Lease) Held(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lost != nil {
+		return fmt.Errorf("archive lock no longer held: %v", l.lost)
+	}
+	state, etag, err := l.l.state(ctx)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("archive lock no longer held: lock object no longer exists")
+	}
+	if state.Owner != l.owner || etag != l.etag {
+		return fmt.Errorf("archive lock no longer held: lease expired and was stolen by %s", state.Owner)
+	}
+	return nil
+}
+
+// Release stops renewing the lease and conditionally deletes the lock object,
+// returning an error if the lease expired and was stolen by another owner, in
+// which case the lock object is retained
+func (l *Lease) Release(ctx context.Context) error {
+	l.cancel()
+	<-l.done
+
+	state, etag, err := l.l.state(ctx)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("error releasing archive lock: lock object no longer exists")
+	}
+	if state.Owner != l.owner {
+		return fmt.Errorf("error releasing archive lock: lease expired and was stolen by %s", state.Owner)
+	}
+
+	_, err = l.l.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &l.l.Bucket,
+		Key:    &l.l.Key,
+	}, s3.WithAPIOptions(smithyhttp.SetHeaderValue("If-Match", etag)))
+	if IsConflict(err) {
+		return fmt.Errorf("error releasing archive lock: lease expired and was stolen")
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting lock object %s: %v", l.l.Key, err)
+	}
+	return nil
+}
+
+// state returns the contents and etag of the lock object, or nil if the lock
+// object does not exist
+func (l *Lock) state(ctx context.Context) (*lockState, string, error) {
+	resp, err := l.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &l.Bucket,
+		Key:    &l.Key,
+	})
+	if err != nil {
+		var notFound *types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("error downloading lock object %s: %v", l.Key, err)
+	}
+	defer resp.Body.Close()
+
+	var state lockState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return nil, "", fmt.Errorf("error parsing lock object %s: %v", l.Key, err)
+	}
+	return &state, aws.ToString(resp.ETag), nil
+}
+
+// IsConflict returns true if the given error indicates that a conditional
+// write failed due to a concurrent modification
+func IsConflict(err error) bool {
+	var re interface{ HTTPStatusCode() int }
+	if errors.As(err, &re) {
+		switch re.HTTPStatusCode() {
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return true
+		}
+	}
+	return false
+}
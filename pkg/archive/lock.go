@@ -0,0 +1,126 @@
+package archive
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive/lock"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/fatih/color"
+)
+
+const (
+	// DefaultLockTTL is the default duration of an archive lease
+	DefaultLockTTL = 10 * time.Minute
+	// DefaultLockWait is the default maximum duration to wait for an archive
+	// lock held by another owner
+	DefaultLockWait = 5 * time.Minute
+)
+
+// lock polling intervals, which double after each failed attempt
+var (
+	lockPollInterval    = 250 * time.Millisecond
+	lockMaxPollInterval = 5 * time.Second
+)
+
+// Lease describes an acquired archive lock
+type Lease = lock.Lease
+
+// LockRequest describes an attempt to acquire an archive lock
+type LockRequest = lock.Request
+
+// LockHeldError indicates that an archive lock is held by another owner
+type LockHeldError = lock.HeldError
+
+// Locker describes an Archive that supports coarse-grained, lease-based
+// locking, excluding concurrent writers for the duration of a long-running
+// operation. Archives are locked after they are opened, so implementations
+// must refresh any state loaded when the archive was opened (e.g. a
+// downloaded database or version index) once the lock is acquired.
+type Locker interface {
+	// TryLock attempts to acquire the archive lock without waiting, returning
+	// a *LockHeldError if the lock is held by another owner, or a nil Lease if
+	// the underlying storage does not support locking
+	TryLock(ctx context.Context, req LockRequest) (Lease, error)
+}
+
+// Lock acquires an exclusive lock on an archive, polling for up to the
+// configured wait duration while the lock is held by another owner and
+// stealing expired leases unless disabled. A nil Lease is returned if the
+// archive does not implement Locker or locking is disabled.
+func Lock(ctx context.Context, a Archive, cfg *settings.Lock) (Lease, error) {
+	l, ok := a.(Locker)
+	if !ok || (cfg != nil && cfg.Disabled) {
+		return nil, nil
+	}
+
+	req := LockRequest{Owner: lockOwner(), Steal: true, TTL: DefaultLockTTL}
+	wait := DefaultLockWait
+	if cfg != nil {
+		req.Steal = !cfg.DisableSteal
+		if cfg.TTL > 0 {
+			req.TTL = time.Duration(cfg.TTL)
+		}
+		if cfg.Wait > 0 {
+			wait = time.Duration(cfg.Wait)
+		}
+	}
+
+	start, interval := time.Now(), lockPollInterval
+	var waiting string
+	for {
+		lease, err := l.TryLock(ctx, req)
+		var held *LockHeldError
+		if !errors.As(err, &held) {
+			if err != nil {
+				return nil, err
+			}
+			if waiting != "" {
+				color.Yellow("acquired archive lock after waiting %s", time.Since(start).Round(time.Millisecond))
+			}
+			return lease, nil
+		}
+
+		remaining := wait - time.Since(start)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("timed out after %s waiting for %v", wait, held)
+		}
+		if msg := held.Error(); msg != waiting {
+			if !req.Steal && !held.Expires.IsZero() && held.Expires.Before(time.Now()) {
+				color.Yellow("waiting up to %s for expired %v, which will not be stolen as stealing is disabled", remaining.Round(time.Second), held)
+			} else {
+				color.Yellow("waiting up to %s for %v", remaining.Round(time.Second), held)
+			}
+			waiting = msg
+		}
+
+		if interval > remaining {
+			interval = remaining
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("interrupted while waiting for %v: %v", held, ctx.Err())
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > lockMaxPollInterval {
+			interval = lockMaxPollInterval
+		}
+	}
+}
+
+// lockOwner returns a unique identifier for the current process, including
+// the hostname (the container handle in Concourse) for troubleshooting
+func lockOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(b))
+}
@@ -0,0 +1,52 @@
+// Package lock provides primitives for coarse-grained, lease-based archive
+// locks, which exclude concurrent writers for the duration of a long-running
+// check or put step.
+package lock
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Request describes an attempt to acquire an archive lock
+type Request struct {
+	// Owner uniquely identifies the process requesting the lock, and is
+	// reported to other processes waiting on the lock
+	Owner string
+	// Steal indicates that a lease held by another owner may be taken over
+	// once it has expired
+	Steal bool
+	// TTL is the duration of the lease, after which it is considered expired
+	TTL time.Duration
+}
+
+// Lease describes an acquired archive lock
+type Lease interface {
+	// Release releases the lock, returning an error if the lease expired and
+	// was stolen by another owner
+	Release(ctx context.Context) error
+}
+
+// HeldError indicates that a lock could not be acquired because it is held by
+// another owner
+type HeldError struct {
+	// Owner identifies the current holder of the lock, if known
+	Owner string
+	// Expires is the time at which the current lease expires, which is zero if
+	// the lease does not expire (e.g. a lock released automatically when the
+	// holding process exits)
+	Expires time.Time
+}
+
+// Error implements the error interface
+func (e *HeldError) Error() string {
+	owner := e.Owner
+	if owner == "" {
+		owner = "unknown owner"
+	}
+	if e.Expires.IsZero() {
+		return fmt.Sprintf("archive lock held by %s", owner)
+	}
+	return fmt.Sprintf("archive lock held by %s until %s", owner, e.Expires.UTC().Format(time.RFC3339))
+}
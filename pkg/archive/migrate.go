@@ -0,0 +1,214 @@
+package archive
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+)
+
+// DefaultMigrateBatchSize is the default number of versions written to the
+// destination archive per Put
+const DefaultMigrateBatchSize = 100
+
+// MigrateOption customizes the behavior of Migrate
+type MigrateOption func(*migrateOptions)
+
+type migrateOptions struct {
+	batchSize int
+	progress  func(done, total int)
+}
+
+// WithMigrateBatchSize sets the number of versions written to the destination
+// archive per Put, where a value less than or equal to zero uses the default
+func WithMigrateBatchSize(n int) MigrateOption {
+	return func(o *migrateOptions) {
+		o.batchSize = n
+	}
+}
+
+// WithMigrateProgress registers a function invoked after each batch of
+// versions is written, with the number of source versions present in the
+// destination and the total number of source versions
+func WithMigrateProgress(fn func(done, total int)) MigrateOption {
+	return func(o *migrateOptions) {
+		o.progress = fn
+	}
+}
+
+// MigrateResult describes the outcome of a successful migration
+type MigrateResult struct {
+	// Copied is the number of versions written to the destination
+	Copied int
+	// Skipped is the number of versions already present in the destination,
+	// written by a previous interrupted migration
+	Skipped int
+	// Total is the number of versions in the source, all of which were verified
+	// to be present in the destination in the same order
+	Total int
+}
+
+// Migrate copies the full version history of the src archive into the dst
+// archive, preserving order and de-duplication. Migrations are resumable: if
+// the destination already contains a prefix of the source history (e.g. from
+// an interrupted run), only the remaining versions are copied, while a
+// destination containing any other history is rejected. After copying, the
+// destination is re-opened and its history verified against the source by
+// count and canonical hash. Metadata archived alongside source versions is
+// copied when both archives implement MetadataStore, replacing any metadata
+// copied by a previous interrupted migration. Retention policies configured on
+// the destination are not applied during migration.
+func Migrate(ctx context.Context, src, dst Config, opts ...MigrateOption) (*MigrateResult, error) {
+	o := migrateOptions{batchSize: DefaultMigrateBatchSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.batchSize <= 0 {
+		o.batchSize = DefaultMigrateBatchSize
+	}
+	dst.Retention = nil
+
+	// read the full source history, removing any duplicates
+	metadata := make(map[[canonical.Size]byte][]Metadata)
+	versions, sums, err := read(ctx, src, "source", metadata)
+	if err != nil {
+		return nil, err
+	}
+	versions, sums = dedupe(versions, sums)
+
+	// copy versions missing from the destination
+	result := &MigrateResult{Total: len(versions)}
+	err = with(ctx, dst, "destination", func(a Archive) error {
+		entries, err := List(ctx, a)
+		if err != nil {
+			return fmt.Errorf("error reading destination history: %v", err)
+		}
+		existing := make([][canonical.Size]byte, len(entries))
+		for i, e := range entries {
+			if existing[i], err = canonical.Hash(e.Version); err != nil {
+				return fmt.Errorf("error hashing destination version %d: %v", i, err)
+			}
+		}
+		if i := mismatch(sums, existing); i >= 0 {
+			return fmt.Errorf("destination history diverges from source at version %d, expected the destination to be empty or contain a prefix of the source history", i)
+		}
+
+		result.Skipped = len(existing)
+		for start := len(existing); start < len(versions); start += o.batchSize {
+			end := start + o.batchSize
+			if end > len(versions) {
+				end = len(versions)
+			}
+			if err := a.Put(ctx, versions[start:end]...); err != nil {
+				return fmt.Errorf("error writing versions to destination: %v", err)
+			}
+			result.Copied += end - start
+			if o.progress != nil {
+				o.progress(end, len(versions))
+			}
+		}
+
+		// copy metadata archived alongside source versions
+		if _, ok := a.(MetadataStore); !ok {
+			return nil
+		}
+		for i, version := range versions {
+			if meta, ok := metadata[sums[i]]; ok {
+				if err := PutMetadata(ctx, a, version, meta); err != nil {
+					return fmt.Errorf("error writing metadata to destination: %v", err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// verify the persisted destination history
+	_, migrated, err := read(ctx, dst, "destination", nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(migrated) != len(sums) {
+		return nil, fmt.Errorf("migration verification failed: expected %d versions in destination, found %d", len(sums), len(migrated))
+	}
+	if i := mismatch(sums, migrated); i >= 0 {
+		return nil, fmt.Errorf("migration verification failed: destination version %d has hash %s, expected %s", i, hex.EncodeToString(migrated[i][:]), hex.EncodeToString(sums[i][:]))
+	}
+	return result, nil
+}
+
+// with initializes the archive described by cfg, invokes fn, and closes the
+// archive, persisting any changes
+func with(ctx context.Context, cfg Config, desc string, fn func(Archive) error) (err error) {
+	a, err := New(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("error initializing %s archive: %v", desc, err)
+	}
+	defer func() {
+		if cerr := a.Close(ctx); err == nil && cerr != nil {
+			err = fmt.Errorf("error closing %s archive: %v", desc, cerr)
+		}
+	}()
+	return fn(a)
+}
+
+// read returns the full ordered history of the archive described by cfg,
+// along with the canonical hash of each version. If metadata is non-nil, it is
+// populated with the metadata archived alongside each version, keyed by hash.
+func read(ctx context.Context, cfg Config, desc string, metadata map[[canonical.Size]byte][]Metadata) (versions [][]byte, sums [][canonical.Size]byte, err error) {
+	err = with(ctx, cfg, desc, func(a Archive) error {
+		entries, err := List(ctx, a)
+		if err != nil {
+			return fmt.Errorf("error reading %s history: %v", desc, err)
+		}
+		versions = make([][]byte, len(entries))
+		sums = make([][canonical.Size]byte, len(entries))
+		for i, e := range entries {
+			versions[i] = e.Version
+			if sums[i], err = canonical.Hash(e.Version); err != nil {
+				return fmt.Errorf("error hashing %s version %d: %v", desc, i, err)
+			}
+			if metadata == nil {
+				continue
+			}
+			meta, err := GetMetadata(ctx, a, e.Version)
+			if err != nil {
+				return fmt.Errorf("error reading %s metadata for version %d: %v", desc, i, err)
+			}
+			if meta != nil {
+				metadata[sums[i]] = meta
+			}
+		}
+		return nil
+	})
+	return versions, sums, err
+}
+
+// dedupe removes all but the first occurrence of each version
+func dedupe(versions [][]byte, sums [][canonical.Size]byte) ([][]byte, [][canonical.Size]byte) {
+	seen := make(map[[canonical.Size]byte]struct{}, len(sums))
+	var i int
+	for j, sum := range sums {
+		if _, ok := seen[sum]; ok {
+			continue
+		}
+		seen[sum] = struct{}{}
+		versions[i], sums[i] = versions[j], sum
+		i++
+	}
+	return versions[:i], sums[:i]
+}
+
+// mismatch returns the index of the first hash in prefix that differs from
+// the corresponding hash in sums, or -1 if prefix is a prefix of sums
+func mismatch(sums, prefix [][canonical.Size]byte) int {
+	for i, sum := range prefix {
+		if i >= len(sums) || sums[i] != sum {
+			return i
+		}
+	}
+	return -1
+}
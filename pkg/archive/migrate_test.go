@@ -0,0 +1,148 @@
+package archive_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive"
+	"github.com/stretchr/testify/assert"
+
+	// register the sql backend used as a migration destination
+	_ "github.com/cludden/concourse-go-sdk/pkg/archive/sql"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	versions := [][]byte{
+		[]byte(`{"id":"a"}`),
+		[]byte(`{"id":"b"}`),
+		[]byte(`{"id":"c"}`),
+		[]byte(`{"id":"d"}`),
+		[]byte(`{"id":"e"}`),
+	}
+
+	config := func(t *testing.T, raw string) archive.Config {
+		var cfg archive.Config
+		if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	put := func(t *testing.T, cfg archive.Config, versions ...[]byte) {
+		a, err := archive.New(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Put(ctx, versions...); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history := func(t *testing.T, cfg archive.Config) [][]byte {
+		a, err := archive.New(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close(ctx)
+		entries, err := archive.List(ctx, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := make([][]byte, len(entries))
+		for i, e := range entries {
+			result[i] = e.Version
+		}
+		return result
+	}
+	meta := []archive.Metadata{{Name: "commit", Value: "abc123"}}
+	putMetadata := func(t *testing.T, cfg archive.Config, version []byte, meta []archive.Metadata) {
+		a, err := archive.New(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := archive.PutMetadata(ctx, a, version, meta); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metadata := func(t *testing.T, cfg archive.Config, version []byte) []archive.Metadata {
+		a, err := archive.New(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close(ctx)
+		meta, err := archive.GetMetadata(ctx, a, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+
+	cases := map[string]struct {
+		existing [][]byte
+		result   *archive.MigrateResult
+		err      string
+	}{
+		"empty": {
+			result: &archive.MigrateResult{Copied: 5, Total: 5},
+		},
+		"resume": {
+			existing: versions[:2],
+			result:   &archive.MigrateResult{Copied: 3, Skipped: 2, Total: 5},
+		},
+		"complete": {
+			existing: versions,
+			result:   &archive.MigrateResult{Skipped: 5, Total: 5},
+		},
+		"diverged": {
+			existing: [][]byte{versions[0], versions[2]},
+			err:      "destination history diverges from source at version 1",
+		},
+	}
+
+	for desc, c := range cases {
+		t.Run(desc, func(t *testing.T) {
+			dir := t.TempDir()
+			src := config(t, fmt.Sprintf(`{"file":{"path":%q}}`, filepath.Join(dir, "archive.jsonl")))
+			dst := config(t, fmt.Sprintf(`{"retention":{"max_versions":1},"sql":{"driver":"sqlite","dsn":%q}}`, filepath.Join(dir, "archive.sqlite")))
+			put(t, src, versions...)
+			putMetadata(t, src, versions[1], meta)
+			if len(c.existing) > 0 {
+				noRetention := dst
+				noRetention.Retention = nil
+				put(t, noRetention, c.existing...)
+			}
+
+			var progress []int
+			result, err := archive.Migrate(ctx, src, dst, archive.WithMigrateBatchSize(2), archive.WithMigrateProgress(func(done, total int) {
+				assert.Equal(t, len(versions), total)
+				progress = append(progress, done)
+			}))
+			if c.err != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.err)
+				}
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, c.result, result)
+			assert.Len(t, progress, (result.Copied+1)/2)
+
+			// retention is not applied during migration
+			assert.Equal(t, versions, history(t, dst))
+
+			// metadata is copied alongside versions
+			assert.Equal(t, meta, metadata(t, dst, versions[1]))
+			assert.Nil(t, metadata(t, dst, versions[0]))
+		})
+	}
+}
@@ -0,0 +1,469 @@
+// Package redis implements a resource version archive persisted to Redis.
+package redis
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/history"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+func init() {
+	archive.Register("redis", archive.NewFactory(New))
+}
+
+const defaultPageSize = 1000
+
+type (
+	// Config describes the available resource-specific configuration settings
+	Config struct {
+		// The redis server address (e.g. localhost:6379)
+		Address string `json:"address" validate:"required"`
+		// The redis database number
+		DB int `json:"db" validate:"min=0"`
+		// The key prefix used for all keys belonging to the resource (e.g.
+		// concourse:my-team:my-pipeline:my-resource)
+		Key string `json:"key" validate:"required"`
+		// The number of versions to read per request when retrieving history
+		// (default: 1000)
+		PageSize int `json:"page_size" validate:"omitempty,min=1"`
+		// The password used to authenticate with redis
+		Password string `json:"password"`
+		// TLS configuration, which enables TLS when specified
+		TLS *TLS `json:"tls,omitempty" validate:"omitempty"`
+		// If specified, the resource's keys expire after the given duration
+		// elapses without any new versions being archived
+		TTL settings.Duration `json:"ttl" validate:"min=0"`
+		// The username used to authenticate with redis (ACL)
+		Username string `json:"username"`
+	}
+
+	// TLS describes TLS settings used to connect to redis
+	TLS struct {
+		// A PEM encoded CA certificate bundle used to verify the server
+		CA string `json:"ca"`
+		// A PEM encoded client certificate, used for mutual TLS
+		Cert string `json:"cert" validate:"required_with=Key"`
+		// Disables server certificate verification, useful for testing
+		InsecureSkipVerify bool `json:"insecure_skip_verify"`
+		// A PEM encoded client private key, used for mutual TLS
+		Key string `json:"key" validate:"required_with=Cert"`
+		// Overrides the server name used to verify the server certificate
+		ServerName string `json:"server_name"`
+	}
+)
+
+// put atomically appends versions that have not previously been archived,
+// assigning each an insertion sequence number, and refreshes key expiration
+//
+// KEYS[1] - hash of version hash => version
+// KEYS[2] - sorted set of version hashes scored by insertion sequence
+// KEYS[3] - insertion sequence counter
+// KEYS[4] - hash of version hash => archive time in unix milliseconds
+// KEYS[5] - hash of version hash => json metadata, refreshed along with the
+// other keys
+// ARGV[1] - ttl in milliseconds, or 0
+// ARGV[2] - current time in unix milliseconds
+// ARGV[3...] - version hash, version pairs
+var put = goredis.NewScript(`
+local added = 0
+for i = 3, #ARGV, 2 do
+	if redis.call('HSETNX', KEYS[1], ARGV[i], ARGV[i + 1]) == 1 then
+		local seq = redis.call('INCR', KEYS[3])
+		redis.call('ZADD', KEYS[2], seq, ARGV[i])
+		redis.call('HSET', KEYS[4], ARGV[i], ARGV[2])
+		added = added + 1
+	end
+end
+local ttl = tonumber(ARGV[1])
+if ttl > 0 and added > 0 then
+	for _, key in ipairs(KEYS) do
+		redis.call('PEXPIRE', key, ttl)
+	end
+end
+return added
+`)
+
+// Archive implements a resource version archive using redis, where each
+// resource's versions are stored in a hash keyed by canonical version hash
+// (for de-duplication) and ordered by a sorted set scored by insertion
+// sequence. Archive times are tracked in a separate hash for use by retention
+// policies.
+type Archive struct {
+	cfg      *Config
+	client   *goredis.Client
+	settings *settings.Settings
+}
+
+func New(ctx context.Context, cfg Config, s *settings.Settings) (*Archive, error) {
+	if cfg.PageSize <= 0 {
+		cfg.PageSize = defaultPageSize
+	}
+
+	opts := &goredis.Options{
+		Addr:     cfg.Address,
+		DB:       cfg.DB,
+		Password: cfg.Password,
+		Username: cfg.Username,
+	}
+	if cfg.TLS != nil {
+		tlsConfig, err := cfg.TLS.config()
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsConfig
+	}
+
+	client := goredis.NewClient(opts)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error connecting to redis: %v", err)
+	}
+	return &Archive{cfg: &cfg, client: client, settings: s}, nil
+}
+
+func (a *Archive) Close(ctx context.Context) error {
+	if err := a.client.Close(); err != nil {
+		return fmt.Errorf("error closing redis client: %v", err)
+	}
+	return nil
+}
+
+func (a *Archive) History(ctx context.Context, latest []byte) ([][]byte, error) {
+	return history.Collect(a.HistoryIter(ctx, latest, 0))
+}
+
+// HistoryIter returns an iterator over the versions returned by History,
+// reading at most pageSize versions per request (default: the configured
+// page size). Pages are read by insertion sequence rather than rank, so that
+// versions pruned concurrently do not cause versions to be skipped.
+func (a *Archive) HistoryIter(ctx context.Context, latest []byte, pageSize int) history.Seq {
+	if pageSize <= 0 {
+		pageSize = a.cfg.PageSize
+	}
+	return func(yield func([]byte, error) bool) {
+		since, ok := history.Since(latest, a.settings)
+		if !ok {
+			return
+		}
+		min := "-inf"
+		if since != nil {
+			sum, err := canonical.Hash(since)
+			if err != nil {
+				yield(nil, fmt.Errorf("error hashing latest version: %v", err))
+				return
+			}
+			seq, err := a.client.ZScore(ctx, a.key("versions"), hex.EncodeToString(sum[:])).Result()
+			if errors.Is(err, goredis.Nil) {
+				return
+			}
+			if err != nil {
+				yield(nil, fmt.Errorf("error locating latest version: %v", err))
+				return
+			}
+			min = "(" + strconv.FormatFloat(seq, 'f', -1, 64)
+		}
+
+		for {
+			members, err := a.client.ZRangeByScoreWithScores(ctx, a.key("versions"), &goredis.ZRangeBy{
+				Min:   min,
+				Max:   "+inf",
+				Count: int64(pageSize),
+			}).Result()
+			if err != nil {
+				yield(nil, fmt.Errorf("error listing versions: %v", err))
+				return
+			}
+			if len(members) == 0 {
+				return
+			}
+
+			hashes := make([]string, len(members))
+			for i, m := range members {
+				hashes[i] = m.Member.(string)
+			}
+			values, err := a.client.HMGet(ctx, a.key("data"), hashes...).Result()
+			if err != nil {
+				yield(nil, fmt.Errorf("error retrieving versions: %v", err))
+				return
+			}
+			for _, v := range values {
+				// skip versions pruned since the page was listed
+				version, ok := v.(string)
+				if !ok {
+					continue
+				}
+				if !yield([]byte(version), nil) {
+					return
+				}
+			}
+			if len(members) < pageSize {
+				return
+			}
+			min = "(" + strconv.FormatFloat(members[len(members)-1].Score, 'f', -1, 64)
+		}
+	}
+}
+
+func (a *Archive) Put(ctx context.Context, versions ...[]byte) error {
+	if len(versions) == 0 {
+		return a.prune(ctx)
+	}
+
+	args := make([]any, 0, 2+len(versions)*2)
+	args = append(args, time.Duration(a.cfg.TTL).Milliseconds(), time.Now().UnixMilli())
+	for _, version := range versions {
+		normalized, err := canonical.Normalize(version)
+		if err != nil {
+			return fmt.Errorf("error normalizing version: %v", err)
+		}
+		sum, err := canonical.Hash(normalized)
+		if err != nil {
+			return fmt.Errorf("error hashing version: %v", err)
+		}
+		args = append(args, hex.EncodeToString(sum[:]), string(normalized))
+	}
+
+	keys := []string{a.key("data"), a.key("versions"), a.key("seq"), a.key("archived"), a.key("metadata")}
+	if err := put.Run(ctx, a.client, keys, args...).Err(); err != nil {
+		return fmt.Errorf("error archiving versions: %v", err)
+	}
+	return a.prune(ctx)
+}
+
+// PutMetadata archives a version along with its metadata, which is stored in
+// a separate hash keyed by canonical version hash
+func (a *Archive) PutMetadata(ctx context.Context, version []byte, metadata []history.Metadata) error {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return fmt.Errorf("error hashing version: %v", err)
+	}
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("error serializing metadata: %v", err)
+	}
+	_, err = a.client.TxPipelined(ctx, func(p goredis.Pipeliner) error {
+		p.HSet(ctx, a.key("metadata"), hex.EncodeToString(sum[:]), string(b))
+		if ttl := time.Duration(a.cfg.TTL); ttl > 0 {
+			p.PExpire(ctx, a.key("metadata"), ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error archiving metadata: %v", err)
+	}
+	return a.Put(ctx, version)
+}
+
+// Has returns true if the given version has been archived
+func (a *Archive) Has(ctx context.Context, version []byte) (bool, error) {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return false, fmt.Errorf("error hashing version: %v", err)
+	}
+	err = a.client.ZScore(ctx, a.key("versions"), hex.EncodeToString(sum[:])).Err()
+	if errors.Is(err, goredis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error locating version: %v", err)
+	}
+	return true, nil
+}
+
+// Metadata returns the metadata archived alongside the given version
+func (a *Archive) Metadata(ctx context.Context, version []byte) ([]history.Metadata, error) {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing version: %v", err)
+	}
+	raw, err := a.client.HGet(ctx, a.key("metadata"), hex.EncodeToString(sum[:])).Result()
+	if errors.Is(err, goredis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving metadata: %v", err)
+	}
+	var metadata []history.Metadata
+	if err := json.Unmarshal([]byte(raw), &metadata); err != nil {
+		return nil, fmt.Errorf("error parsing metadata: %v", err)
+	}
+	return metadata, nil
+}
+
+// prune removes the oldest versions according to the configured retention
+// policy. Versions without an entry in the archived hash have an unknown
+// archive time and are only pruned by max versions.
+func (a *Archive) prune(ctx context.Context) error {
+	retention := a.settings.Retention
+	if retention == nil {
+		return nil
+	}
+
+	hashes, err := a.client.ZRange(ctx, a.key("versions"), 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("error listing versions: %v", err)
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	values, err := a.client.HMGet(ctx, a.key("archived"), hashes...).Result()
+	if err != nil {
+		return fmt.Errorf("error retrieving archive times: %v", err)
+	}
+	archived := make([]time.Time, len(values))
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+				archived[i] = time.UnixMilli(ms)
+			}
+		}
+	}
+
+	n := retention.Prune(time.Now(), archived)
+	if n == 0 {
+		return nil
+	}
+	pruned := hashes[:n]
+	if retention.DryRun {
+		values, err := a.client.HMGet(ctx, a.key("data"), pruned...).Result()
+		if err != nil {
+			return fmt.Errorf("error retrieving versions: %v", err)
+		}
+		versions := make([][]byte, 0, len(values))
+		for _, v := range values {
+			if version, ok := v.(string); ok {
+				versions = append(versions, []byte(version))
+			}
+		}
+		retention.Report(versions)
+		return nil
+	}
+
+	if _, err := a.remove(ctx, pruned); err != nil {
+		return fmt.Errorf("error pruning versions: %v", err)
+	}
+	return nil
+}
+
+// List returns all versions along with the time each was archived, which is
+// zero for versions without an entry in the archived hash
+func (a *Archive) List(ctx context.Context) ([]history.Entry, error) {
+	hashes, err := a.client.ZRange(ctx, a.key("versions"), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error listing versions: %v", err)
+	}
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	values, err := a.client.HMGet(ctx, a.key("data"), hashes...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving versions: %v", err)
+	}
+	times, err := a.client.HMGet(ctx, a.key("archived"), hashes...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving archive times: %v", err)
+	}
+
+	entries := make([]history.Entry, 0, len(values))
+	for i, v := range values {
+		version, ok := v.(string)
+		if !ok {
+			continue
+		}
+		e := history.Entry{Version: []byte(version)}
+		if s, ok := times[i].(string); ok {
+			if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+				e.Archived = time.UnixMilli(ms)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Delete removes the given versions
+func (a *Archive) Delete(ctx context.Context, versions ...[]byte) (int, error) {
+	hashes := make([]string, len(versions))
+	for i, version := range versions {
+		sum, err := canonical.Hash(version)
+		if err != nil {
+			return 0, fmt.Errorf("error hashing version: %v", err)
+		}
+		hashes[i] = hex.EncodeToString(sum[:])
+	}
+	n, err := a.remove(ctx, hashes)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting versions: %v", err)
+	}
+	return n, nil
+}
+
+// remove atomically removes the versions with the given hashes, returning the
+// number of versions removed
+func (a *Archive) remove(ctx context.Context, hashes []string) (int, error) {
+	if len(hashes) == 0 {
+		return 0, nil
+	}
+	members := make([]any, len(hashes))
+	for i, h := range hashes {
+		members[i] = h
+	}
+	var removed *goredis.IntCmd
+	_, err := a.client.TxPipelined(ctx, func(p goredis.Pipeliner) error {
+		removed = p.ZRem(ctx, a.key("versions"), members...)
+		p.HDel(ctx, a.key("data"), hashes...)
+		p.HDel(ctx, a.key("archived"), hashes...)
+		p.HDel(ctx, a.key("metadata"), hashes...)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(removed.Val()), nil
+}
+
+// key returns a fully qualified redis key. The configured key prefix and
+// namespace are wrapped in a hash tag so that all of a resource's keys are
+// assigned to the same cluster slot.
+func (a *Archive) key(name string) string {
+	if a.settings.Namespace != "" {
+		return fmt.Sprintf("{%s:%s}:%s", a.cfg.Key, a.settings.Namespace, name)
+	}
+	return fmt.Sprintf("{%s}:%s", a.cfg.Key, name)
+}
+
+// config builds a tls.Config from the provided settings
+func (t *TLS) config() (*tls.Config, error) {
+	c := &tls.Config{
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+	}
+	if t.CA != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(t.CA)) {
+			return nil, errors.New("invalid tls config: no valid CA certificates found")
+		}
+		c.RootCAs = pool
+	}
+	if t.Cert != "" {
+		cert, err := tls.X509KeyPair([]byte(t.Cert), []byte(t.Key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls config: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
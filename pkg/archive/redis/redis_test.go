@@ -0,0 +1,189 @@
+package redis
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/internal/archivetest"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchive(t *testing.T) {
+	archivetest.Run(t, func(t *testing.T) archivetest.Opener {
+		srv := miniredis.RunT(t)
+		srv.RequireUserAuth("concourse", "secret")
+		cfg := Config{
+			Address:  srv.Addr(),
+			Key:      "concourse:my-team:my-pipeline:my-resource",
+			PageSize: 2,
+			Password: "secret",
+			Username: "concourse",
+		}
+		return func(s *settings.Settings) (archivetest.Archive, error) {
+			return New(context.Background(), cfg, s)
+		}
+	})
+}
+
+func TestArchiveTTL(t *testing.T) {
+	srv := miniredis.RunT(t)
+	ctx := context.Background()
+	cfg := Config{
+		Address: srv.Addr(),
+		Key:     "concourse:my-team:my-pipeline:my-resource",
+		TTL:     settings.Duration(time.Hour),
+	}
+
+	a, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, a.Close(ctx))
+	}()
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`)))
+
+	// verify keys expire after ttl
+	assert.Equal(t, time.Hour, srv.TTL(a.key("versions")))
+	srv.FastForward(time.Hour)
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 0)
+}
+
+func TestArchiveRetention(t *testing.T) {
+	srv := miniredis.RunT(t)
+
+	ctx := context.Background()
+	retention := &settings.Retention{DryRun: true, MaxVersions: 3}
+	a, err := New(ctx, Config{Address: srv.Addr(), Key: "my-resource"}, &settings.Settings{Retention: retention})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close(ctx)
+
+	// dry run should not prune any versions
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"a"}`), []byte(`{"id":"b"}`), []byte(`{"id":"c"}`), []byte(`{"id":"d"}`)))
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 4)
+
+	// oldest versions are pruned according to max versions
+	retention.DryRun = false
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"e"}`)))
+	versions, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"id":"c"}`),
+		[]byte(`{"id":"d"}`),
+		[]byte(`{"id":"e"}`),
+	}, versions)
+
+	// expired versions are pruned according to max age, and versions with
+	// an unknown archive time are retained
+	old := strconv.FormatInt(time.Now().Add(-48*time.Hour).UnixMilli(), 10)
+	hashes, err := srv.ZMembers(a.key("versions"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, field := range hashes {
+		srv.HSet(a.key("archived"), field, old)
+	}
+	srv.HDel(a.key("archived"), hashes[1])
+	a.settings.Retention = &settings.Retention{MaxAge: settings.Duration(24 * time.Hour)}
+	assert.NoError(t, a.Put(ctx))
+	versions, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"id":"d"}`),
+		[]byte(`{"id":"e"}`),
+	}, versions)
+	archived, err := srv.HKeys(a.key("archived"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{hashes[2]}, archived)
+}
+
+func TestArchiveTLS(t *testing.T) {
+	certPEM, keyPEM := generateCertificate(t)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	srv, err := miniredis.RunTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer srv.Close()
+
+	ctx := context.Background()
+	cfg := Config{
+		Address: srv.Addr(),
+		Key:     "my-resource",
+		TLS: &TLS{
+			CA:         string(certPEM),
+			ServerName: "localhost",
+		},
+	}
+
+	a, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close(ctx)
+
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"foo"}`)))
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`)}, versions)
+
+	// verify untrusted servers are rejected
+	cfg.TLS.CA = ""
+	_, err = New(ctx, cfg, &settings.Settings{})
+	assert.Error(t, err)
+}
+
+// generateCertificate generates a self-signed PEM encoded certificate and
+// private key for localhost
+func generateCertificate(t *testing.T) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error marshaling key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -0,0 +1,81 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/go-playground/validator/v10"
+)
+
+// Factory initializes an archive backend from its raw json configuration
+type Factory func(ctx context.Context, raw json.RawMessage, s *settings.Settings) (Archive, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes an archive backend available via the given config key. It
+// panics if called twice with the same name or if the factory is nil.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if name == "" {
+		panic("archive: Register name is empty")
+	}
+	if factory == nil {
+		panic("archive: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("archive: Register called twice for backend " + name)
+	}
+	registry[name] = factory
+}
+
+// Backends returns a sorted list of the names of all registered backends
+func Backends() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewFactory returns a Factory for a backend with a typed config, which is
+// decoded from json and validated using `validate` struct tags prior to
+// invoking the provided constructor
+func NewFactory[C any, A Archive](fn func(context.Context, C, *settings.Settings) (A, error)) Factory {
+	return func(ctx context.Context, raw json.RawMessage, s *settings.Settings) (Archive, error) {
+		var cfg C
+		if len(bytes.TrimSpace(raw)) > 0 {
+			if err := json.Unmarshal(raw, &cfg); err != nil {
+				return nil, fmt.Errorf("error parsing config: %v", err)
+			}
+		}
+		if err := validator.New().StructCtx(ctx, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+
+		a, err := fn(ctx, cfg, s)
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+}
+
+// lookup returns the factory registered with the given name
+func lookup(name string) (Factory, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	f, ok := registry[name]
+	return f, ok
+}
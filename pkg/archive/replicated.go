@@ -0,0 +1,431 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/history"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/fatih/color"
+)
+
+// ReplicatedConfig describes a composite archive that replicates versions from
+// a primary archive to one or more secondary archives
+type ReplicatedConfig struct {
+	// Primary describes the archive that versions are read from, consisting of
+	// exactly one backend config
+	Primary Config `json:"primary"`
+	// Resync copies versions archived by a secondary but absent from the
+	// primary (e.g. versions written while the primary was unavailable) back
+	// to the primary when the archive is opened, along with any metadata,
+	// which lists the full history of every replica
+	Resync bool `json:"resync"`
+	// Secondaries describes the archives that versions are replicated to, each
+	// consisting of exactly one backend config, which are read in order when
+	// the primary is unavailable
+	Secondaries []Config `json:"secondaries" validate:"min=1"`
+	// Verify compares the history of each secondary with the primary when the
+	// archive is opened, logging any divergence, which lists the full history
+	// of every replica
+	Verify bool `json:"verify"`
+}
+
+// Replicated implements a composite archive that writes versions to a primary
+// archive and every secondary archive, and reads versions from the primary,
+// falling back to each secondary in order if the primary cannot be opened or
+// read. Write failures are only returned for the primary, or for every
+// secondary if the primary is unavailable, while failed writes to a secondary
+// are logged as divergence. Common settings (e.g. retention and namespace)
+// apply to every replica, and encryption is applied before replication.
+type Replicated struct {
+	primary     *replica
+	secondaries []*replica
+}
+
+// replica describes a single archive within a replicated archive
+type replica struct {
+	Archive
+	name string
+}
+
+// Divergence describes how the history of a secondary archive differs from
+// the history of the primary archive
+type Divergence struct {
+	// Extra is the number of versions archived by the secondary that are absent
+	// from the primary
+	Extra int
+	// Missing is the number of versions archived by the primary that are
+	// absent from the secondary
+	Missing int
+	// Replica identifies the secondary archive (e.g. "secondary 1 (file)")
+	Replica string
+}
+
+// NewReplicated initializes a replicated archive, opening the primary and
+// each secondary archive. Replicas that fail to open are skipped with a
+// warning, and an error is returned only if no replica could be opened.
+func NewReplicated(ctx context.Context, cfg ReplicatedConfig, s *settings.Settings) (*Replicated, error) {
+	type replicaConfig struct {
+		desc    string
+		name    string
+		factory Factory
+		raw     json.RawMessage
+	}
+
+	// resolve every replica's backend before opening any replica, so that
+	// configuration errors are never mistaken for unavailable replicas
+	configs := make([]replicaConfig, 0, len(cfg.Secondaries)+1)
+	for i, c := range append([]Config{cfg.Primary}, cfg.Secondaries...) {
+		desc := "primary"
+		if i > 0 {
+			desc = fmt.Sprintf("secondary %d", i)
+		}
+		if !reflect.ValueOf(c.Settings).IsZero() {
+			return nil, fmt.Errorf("invalid %s config: common settings must be configured at the top level of the archive config", desc)
+		}
+		backends, err := c.backends()
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s config: %v", desc, err)
+		}
+		name, factory, err := backend(backends)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s config: %v", desc, err)
+		}
+		configs = append(configs, replicaConfig{desc: desc, name: name, factory: factory, raw: backends[name]})
+	}
+
+	r := &Replicated{}
+	for i, c := range configs {
+		name := fmt.Sprintf("%s (%s)", c.desc, c.name)
+		a, err := c.factory(ctx, c.raw, s)
+		if err != nil {
+			color.Yellow("error opening %s archive, which will not be used: %v", name, err)
+			continue
+		}
+		if i == 0 {
+			r.primary = &replica{Archive: a, name: name}
+		} else {
+			r.secondaries = append(r.secondaries, &replica{Archive: a, name: name})
+		}
+	}
+	if r.primary == nil && len(r.secondaries) == 0 {
+		return nil, errors.New("error opening replicated archive: no replica archives available")
+	}
+	if r.primary == nil {
+		color.Yellow("primary archive unavailable, falling back to %s archive", r.secondaries[0].name)
+	}
+
+	if cfg.Resync && r.primary != nil && len(r.secondaries) > 0 {
+		n, err := r.Resync(ctx)
+		if err != nil {
+			color.Yellow("error resyncing replicated archives: %v", err)
+		}
+		if n > 0 {
+			color.Yellow("copied %d version(s) missing from the primary archive from secondary archives", n)
+		}
+	}
+	if cfg.Verify && r.primary != nil && len(r.secondaries) > 0 {
+		divergence, err := r.Divergence(ctx)
+		if err != nil {
+			color.Yellow("error verifying replicated archives: %v", err)
+		}
+		for _, d := range divergence {
+			color.Yellow("%s archive has diverged from the primary archive: %d version(s) missing, %d version(s) not present in the primary", d.Replica, d.Missing, d.Extra)
+		}
+	}
+	return r, nil
+}
+
+// Close closes every replica, returning an error if the primary fails to
+// close, or every secondary if the primary is unavailable
+func (r *Replicated) Close(ctx context.Context) error {
+	return r.write("closing", func(a *replica) error {
+		return a.Close(ctx)
+	})
+}
+
+func (r *Replicated) History(ctx context.Context, latest []byte) (versions [][]byte, err error) {
+	err = r.read("reading history", func(a *replica) error {
+		versions, err = a.History(ctx, latest)
+		return err
+	})
+	return versions, err
+}
+
+// HistoryIter returns an iterator over the versions returned by History,
+// falling back to the next replica only if a replica fails before yielding
+// any versions
+func (r *Replicated) HistoryIter(ctx context.Context, latest []byte, pageSize int) history.Seq {
+	return func(yield func([]byte, error) bool) {
+		var failed error
+		err := r.read("reading history", func(a *replica) error {
+			var yielded bool
+			var err error
+			HistoryIter(ctx, a.Archive, latest, pageSize)(func(v []byte, e error) bool {
+				if e != nil {
+					err = e
+					return false
+				}
+				yielded = true
+				return yield(v, nil)
+			})
+			if err != nil && yielded {
+				failed = err
+				return nil
+			}
+			return err
+		})
+		if err == nil {
+			err = failed
+		}
+		if err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// Put archives versions to every replica
+func (r *Replicated) Put(ctx context.Context, versions ...[]byte) error {
+	return r.write("archiving versions to", func(a *replica) error {
+		return a.Put(ctx, versions...)
+	})
+}
+
+// List returns all versions archived by the primary, or the first available
+// secondary
+func (r *Replicated) List(ctx context.Context) (entries []Entry, err error) {
+	err = r.read("listing versions", func(a *replica) error {
+		entries, err = List(ctx, a.Archive)
+		return err
+	})
+	return entries, err
+}
+
+// Delete removes the given versions from every replica, returning the number
+// of versions removed from the primary, or the first available secondary
+func (r *Replicated) Delete(ctx context.Context, versions ...[]byte) (n int, err error) {
+	var counted bool
+	err = r.write("deleting versions from", func(a *replica) error {
+		removed, err := Delete(ctx, a.Archive, versions...)
+		if err == nil && !counted {
+			n, counted = removed, true
+		}
+		return err
+	})
+	return n, err
+}
+
+// PutMetadata archives a version along with its metadata to every replica
+func (r *Replicated) PutMetadata(ctx context.Context, version []byte, metadata []Metadata) error {
+	return r.write("archiving metadata to", func(a *replica) error {
+		return PutMetadata(ctx, a.Archive, version, metadata)
+	})
+}
+
+// Metadata returns the metadata archived alongside the given version by the
+// primary, or the first available secondary
+func (r *Replicated) Metadata(ctx context.Context, version []byte) (metadata []Metadata, err error) {
+	err = r.read("reading metadata", func(a *replica) error {
+		metadata, err = GetMetadata(ctx, a.Archive, version)
+		return err
+	})
+	return metadata, err
+}
+
+// Has returns true if the given version has been archived by the primary, or
+// the first available secondary
+func (r *Replicated) Has(ctx context.Context, version []byte) (found bool, err error) {
+	err = r.read("locating version", func(a *replica) error {
+		found, err = Has(ctx, a.Archive, version)
+		return err
+	})
+	return found, err
+}
+
+// TryLock acquires the lock of every available replica that implements
+// Locker, in read order, returning a combined Lease that releases every
+// replica's lease, or a nil Lease if no replica implements Locker. If any
+// replica's lock cannot be acquired, the leases already acquired are released.
+func (r *Replicated) TryLock(ctx context.Context, req LockRequest) (Lease, error) {
+	var leases replicatedLease
+	for _, a := range r.replicas() {
+		l, ok := a.Archive.(Locker)
+		if !ok {
+			continue
+		}
+		lease, err := l.TryLock(ctx, req)
+		if err != nil {
+			if rerr := leases.Release(ctx); rerr != nil {
+				color.Yellow("error releasing replica archive locks: %v", rerr)
+			}
+			return nil, fmt.Errorf("error locking %s archive: %w", a.name, err)
+		}
+		if lease != nil {
+			leases = append(leases, lease)
+		}
+	}
+	if len(leases) == 0 {
+		return nil, nil
+	}
+	return leases, nil
+}
+
+// replicatedLease describes the leases held on each replica of a replicated
+// archive
+type replicatedLease []Lease
+
+// Release releases every replica's lease, returning the combined errors
+func (l replicatedLease) Release(ctx context.Context) error {
+	errs := make([]error, 0, len(l))
+	for _, lease := range l {
+		if err := lease.Release(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Divergence compares the history of each available secondary with the
+// history of the primary by canonical version hash, ignoring order, and
+// returns the secondaries that differ from the primary
+func (r *Replicated) Divergence(ctx context.Context) ([]Divergence, error) {
+	if r.primary == nil {
+		return nil, errors.New("primary archive unavailable")
+	}
+	primary, err := hashes(ctx, r.primary)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Divergence
+	for _, a := range r.secondaries {
+		secondary, err := hashes(ctx, a)
+		if err != nil {
+			return nil, err
+		}
+		d := Divergence{Replica: a.name}
+		for sum := range primary {
+			if _, ok := secondary[sum]; !ok {
+				d.Missing++
+			}
+		}
+		for sum := range secondary {
+			if _, ok := primary[sum]; !ok {
+				d.Extra++
+			}
+		}
+		if d.Missing > 0 || d.Extra > 0 {
+			result = append(result, d)
+		}
+	}
+	return result, nil
+}
+
+// Resync copies versions archived by any available secondary but absent from
+// the primary back to the primary, in secondary order, along with any
+// metadata, and returns the number of versions copied. Versions deleted from
+// the primary while a secondary was unavailable are copied back as well.
+func (r *Replicated) Resync(ctx context.Context) (int, error) {
+	if r.primary == nil {
+		return 0, errors.New("primary archive unavailable")
+	}
+	primary, err := hashes(ctx, r.primary)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, a := range r.secondaries {
+		entries, err := List(ctx, a.Archive)
+		if err != nil {
+			return n, fmt.Errorf("error listing %s archive history: %v", a.name, err)
+		}
+		for _, e := range entries {
+			sum, err := canonical.Hash(e.Version)
+			if err != nil {
+				return n, fmt.Errorf("error hashing %s archive version: %v", a.name, err)
+			}
+			if _, ok := primary[sum]; ok {
+				continue
+			}
+			metadata, err := GetMetadata(ctx, a.Archive, e.Version)
+			if err != nil {
+				return n, fmt.Errorf("error reading %s archive metadata: %v", a.name, err)
+			}
+			if metadata != nil {
+				err = PutMetadata(ctx, r.primary.Archive, e.Version, metadata)
+			} else {
+				err = r.primary.Put(ctx, e.Version)
+			}
+			if err != nil {
+				return n, fmt.Errorf("error archiving version to %s archive: %v", r.primary.name, err)
+			}
+			primary[sum] = struct{}{}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// replicas returns the available replicas in read order
+func (r *Replicated) replicas() []*replica {
+	if r.primary == nil {
+		return r.secondaries
+	}
+	return append([]*replica{r.primary}, r.secondaries...)
+}
+
+// read invokes fn with each available replica in read order until it
+// succeeds, logging each failure that results in a fallback
+func (r *Replicated) read(desc string, fn func(*replica) error) (err error) {
+	replicas := r.replicas()
+	for i, a := range replicas {
+		if err = fn(a); err == nil || i == len(replicas)-1 {
+			break
+		}
+		color.Yellow("error %s from %s archive, falling back to %s archive: %v", desc, a.name, replicas[i+1].name, err)
+	}
+	return err
+}
+
+// write invokes fn with every available replica, returning the primary's
+// error, or an error if every secondary fails while the primary is
+// unavailable. Secondary failures are logged, as the secondary may have
+// diverged from the primary.
+func (r *Replicated) write(desc string, fn func(*replica) error) (err error) {
+	if r.primary != nil {
+		err = fn(r.primary)
+	}
+	var failed int
+	for _, a := range r.secondaries {
+		if serr := fn(a); serr != nil {
+			failed++
+			color.Yellow("error %s %s archive, which may have diverged from the primary archive: %v", desc, a.name, serr)
+			if r.primary == nil && failed == len(r.secondaries) {
+				err = fmt.Errorf("error %s every available replica archive: %w", desc, serr)
+			}
+		}
+	}
+	return err
+}
+
+// hashes returns the set of canonical version hashes archived by a replica
+func hashes(ctx context.Context, a *replica) (map[[canonical.Size]byte]struct{}, error) {
+	entries, err := List(ctx, a.Archive)
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s archive history: %v", a.name, err)
+	}
+	sums := make(map[[canonical.Size]byte]struct{}, len(entries))
+	for _, e := range entries {
+		sum, err := canonical.Hash(e.Version)
+		if err != nil {
+			return nil, fmt.Errorf("error hashing %s archive version: %v", a.name, err)
+		}
+		sums[sum] = struct{}{}
+	}
+	return sums, nil
+}
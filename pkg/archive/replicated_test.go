@@ -0,0 +1,249 @@
+package archive_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/file"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicated(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	primary, secondary := filepath.Join(dir, "primary.jsonl"), filepath.Join(dir, "secondary.jsonl")
+	open := func(primary string) (archive.Archive, error) {
+		var cfg archive.Config
+		if err := json.Unmarshal([]byte(fmt.Sprintf(`{"replicated":{"primary":{"file":{"path":%q}},"secondaries":[{"file":{"path":%q}}]}}`, primary, secondary)), &cfg); err != nil {
+			return nil, err
+		}
+		return archive.New(ctx, cfg)
+	}
+	history := func(path string) [][]byte {
+		a, err := file.New(ctx, file.Config{Path: path}, &settings.Settings{})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer a.Close(ctx)
+		versions, err := a.History(ctx, nil)
+		assert.NoError(t, err)
+		return versions
+	}
+
+	// versions are written to every replica
+	a, err := open(primary)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`)))
+	assert.NoError(t, archive.PutMetadata(ctx, a, []byte(`{"id":"baz"}`), []archive.Metadata{{Name: "commit", Value: "abc123"}}))
+	assert.NoError(t, a.Close(ctx))
+	expected := [][]byte{[]byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`), []byte(`{"id":"baz"}`)}
+	assert.Equal(t, expected, history(primary))
+	assert.Equal(t, expected, history(secondary))
+
+	// divergence is reported by comparing secondaries with the primary
+	p, err := file.New(ctx, file.Config{Path: primary}, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, p.Put(ctx, []byte(`{"id":"qux"}`)))
+	assert.NoError(t, p.Close(ctx))
+	a, err = open(primary)
+	if !assert.NoError(t, err) {
+		return
+	}
+	divergence, err := a.(*archive.Replicated).Divergence(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []archive.Divergence{{Missing: 1, Replica: "secondary 1 (file)"}}, divergence)
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 4)
+	n, err := archive.Delete(ctx, a, []byte(`{"id":"qux"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, a.Close(ctx))
+
+	// reads fall back to secondaries when the primary is unavailable
+	blocked := filepath.Join(dir, "blocked")
+	if !assert.NoError(t, os.WriteFile(blocked, nil, 0644)) {
+		return
+	}
+	a, err = open(filepath.Join(blocked, "primary.jsonl"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	versions, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, versions)
+	meta, err := archive.GetMetadata(ctx, a, []byte(`{"id":"baz"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []archive.Metadata{{Name: "commit", Value: "abc123"}}, meta)
+	_, err = a.(*archive.Replicated).Divergence(ctx)
+	assert.EqualError(t, err, "primary archive unavailable")
+	assert.NoError(t, a.Close(ctx))
+}
+
+func TestReplicatedResync(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	primary, secondary := filepath.Join(dir, "primary.jsonl"), filepath.Join(dir, "secondary.jsonl")
+	open := func(primary string, resync bool) (archive.Archive, error) {
+		var cfg archive.Config
+		if err := json.Unmarshal([]byte(fmt.Sprintf(`{"replicated":{"primary":{"file":{"path":%q}},"secondaries":[{"file":{"path":%q}}],"resync":%t}}`, primary, secondary, resync)), &cfg); err != nil {
+			return nil, err
+		}
+		return archive.New(ctx, cfg)
+	}
+
+	a, err := open(primary, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"foo"}`)))
+	assert.NoError(t, a.Close(ctx))
+
+	// versions archived while the primary is unavailable are written only to
+	// secondaries
+	blocked := filepath.Join(dir, "blocked")
+	if !assert.NoError(t, os.WriteFile(blocked, nil, 0644)) {
+		return
+	}
+	a, err = open(filepath.Join(blocked, "primary.jsonl"), false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"bar"}`)))
+	assert.NoError(t, archive.PutMetadata(ctx, a, []byte(`{"id":"baz"}`), []archive.Metadata{{Name: "commit", Value: "abc123"}}))
+	assert.NoError(t, a.Close(ctx))
+
+	a, err = open(primary, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	divergence, err := a.(*archive.Replicated).Divergence(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []archive.Divergence{{Extra: 2, Replica: "secondary 1 (file)"}}, divergence)
+	assert.NoError(t, a.Close(ctx))
+
+	// resync copies them back to the primary along with their metadata
+	a, err = open(primary, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	divergence, err = a.(*archive.Replicated).Divergence(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, divergence)
+	n, err := a.(*archive.Replicated).Resync(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.NoError(t, a.Close(ctx))
+
+	p, err := file.New(ctx, file.Config{Path: primary}, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer p.Close(ctx)
+	versions, err := p.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"foo"}`), []byte(`{"id":"bar"}`), []byte(`{"id":"baz"}`)}, versions)
+	meta, err := p.Metadata(ctx, []byte(`{"id":"baz"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []archive.Metadata{{Name: "commit", Value: "abc123"}}, meta)
+}
+
+func TestReplicatedLock(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	primary, secondary := filepath.Join(dir, "primary.jsonl"), filepath.Join(dir, "secondary.jsonl")
+	var cfg archive.Config
+	if !assert.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(`{"replicated":{"primary":{"file":{"path":%q}},"secondaries":[{"inmem":{}},{"file":{"path":%q}}]}}`, primary, secondary)), &cfg)) {
+		return
+	}
+	a, err := archive.New(ctx, cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close(ctx)
+	tryLock := func(path string) (archive.Lease, error) {
+		f, err := file.New(ctx, file.Config{Path: path}, &settings.Settings{})
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close(ctx)
+		return f.TryLock(ctx, archive.LockRequest{Owner: "other"})
+	}
+
+	// every replica that supports locking is locked until released
+	lease, err := a.(archive.Locker).TryLock(ctx, archive.LockRequest{Owner: "test"})
+	if !assert.NoError(t, err) || !assert.NotNil(t, lease) {
+		return
+	}
+	var held *archive.LockHeldError
+	for _, path := range []string{primary, secondary} {
+		_, err := tryLock(path)
+		if assert.ErrorAs(t, err, &held) {
+			assert.Equal(t, "test", held.Owner)
+		}
+	}
+	assert.NoError(t, lease.Release(ctx))
+
+	// leases already acquired are released if any replica is locked
+	other, err := tryLock(secondary)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = a.(archive.Locker).TryLock(ctx, archive.LockRequest{Owner: "test"})
+	if assert.ErrorAs(t, err, &held) {
+		assert.Equal(t, "other", held.Owner)
+		assert.Contains(t, err.Error(), "error locking secondary 2 (file) archive")
+	}
+	lease, err = tryLock(primary)
+	if assert.NoError(t, err) {
+		assert.NoError(t, lease.Release(ctx))
+	}
+	assert.NoError(t, other.Release(ctx))
+}
+
+func TestReplicatedInvalidConfig(t *testing.T) {
+	cases := map[string]struct {
+		config string
+		err    string
+	}{
+		"no_secondaries": {
+			config: `{"replicated":{"primary":{"inmem":{}}}}`,
+			err:    "Secondaries",
+		},
+		"no_primary": {
+			config: `{"replicated":{"secondaries":[{"inmem":{}}]}}`,
+			err:    "invalid primary config: no archive backend configured",
+		},
+		"unknown_secondary": {
+			config: `{"replicated":{"primary":{"inmem":{}},"secondaries":[{"foo":{}}]}}`,
+			err:    `invalid secondary 1 config: unknown archive backend "foo"`,
+		},
+		"nested_settings": {
+			config: `{"replicated":{"primary":{"inmem":{}},"secondaries":[{"force_history":true,"inmem":{}}]}}`,
+			err:    "invalid secondary 1 config: common settings must be configured at the top level of the archive config",
+		},
+	}
+
+	for desc, c := range cases {
+		t.Run(desc, func(t *testing.T) {
+			var cfg archive.Config
+			if !assert.NoError(t, json.Unmarshal([]byte(c.config), &cfg)) {
+				return
+			}
+			_, err := archive.New(context.Background(), cfg)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), c.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package s3
+
+import (
+	"context"
+	"path"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive/internal/awsutil"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/lock"
+)
+
+const lockObject = ".lock"
+
+// TryLock attempts to acquire the archive lock by conditionally creating a
+// lock object under the configured prefix, which records the owner and
+// expiry of the lease. An expired lease is stolen, if permitted, by
+// conditionally replacing the lock object, with expiry evaluated using the
+// local clock. Once acquired, the version index is refreshed to include
+// versions archived by the previous holder.
+func (a *Archive) TryLock(ctx context.Context, req lock.Request) (lock.Lease, error) {
+	l := &awsutil.Lock{Bucket: a.cfg.Bucket, Client: a.s3, Key: a.lockKey()}
+	lease, err := l.TryLock(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.list(ctx); err != nil {
+		lease.Release(ctx)
+		return nil, err
+	}
+	return lease, nil
+}
+
+// lockKey returns the object key of the lock object
+func (a *Archive) lockKey() string {
+	return path.Join(a.cfg.Prefix, lockObject)
+}
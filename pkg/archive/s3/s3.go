@@ -0,0 +1,537 @@
+// Package s3 implements a resource version archive that persists each version
+// as an individual S3 object.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/cludden/concourse-go-sdk/pkg/archive"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/history"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/internal/awsutil"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/oklog/ulid/v2"
+)
+
+func init() {
+	archive.Register("s3", archive.NewFactory(New))
+}
+
+const (
+	defaultConcurrency = 10
+	defaultPageSize    = 1000
+	deleteBatchSize    = 1000
+	metadataPrefix     = "metadata"
+	objectExt          = ".json"
+)
+
+type (
+	// Config describes the available resource-specific configuration settings
+	Config struct {
+		// The bucket name where versions are persisted
+		Bucket string `json:"bucket" validate:"required"`
+		// The maximum number of concurrent S3 requests (default: 10)
+		Concurrency int `json:"concurrency" validate:"omitempty,min=1"`
+		// AWS session credentials
+		Credentials *Credentials `json:"credentials,omitempty" validate:"omitempty"`
+		// A custom S3 endpoint, useful for testing
+		Endpoint string `json:"endpoint"`
+		// The S3 key prefix under which version objects are persisted (e.g.
+		// my-team/my-pipeline/my-resource), which is suffixed with the namespace
+		// if configured
+		Prefix string `json:"prefix" validate:"required"`
+		// The AWS region where the bucket was created
+		Region string `json:"region" validate:"required"`
+	}
+
+	// Credentials describes AWS session credentials used for authenticating with S3
+	Credentials = awsutil.Credentials
+)
+
+// Archive implements a resource version archive backed by AWS S3, where each
+// version is persisted as an individual object keyed by a ULID (preserving
+// insertion order) and the version's canonical hash (for de-duplication).
+// Concurrent writers may archive the same version more than once, in which
+// case the oldest object determines the version's order, and every object is
+// removed when the version is deleted or pruned.
+type Archive struct {
+	cfg *Config
+	// index contains the keys of every object archived for each version hash,
+	// oldest first
+	index map[[canonical.Size]byte][]string
+	// keys contains the key of the oldest object archived for each version,
+	// in insertion order
+	keys     []string
+	s3       *awss3.Client
+	settings *settings.Settings
+}
+
+func New(ctx context.Context, cfg Config, s *settings.Settings) (*Archive, error) {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = defaultConcurrency
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	if s.Namespace != "" {
+		cfg.Prefix = path.Join(cfg.Prefix, s.Namespace)
+	}
+
+	client, err := awsutil.NewS3Client(ctx, awsutil.Config{
+		Credentials: cfg.Credentials,
+		Endpoint:    cfg.Endpoint,
+		Region:      cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Archive{cfg: &cfg, s3: client, settings: s}
+	if err := a.list(ctx); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Archive) Close(ctx context.Context) error {
+	return nil
+}
+
+func (a *Archive) History(ctx context.Context, latest []byte) ([][]byte, error) {
+	return history.Collect(a.HistoryIter(ctx, latest, 0))
+}
+
+// HistoryIter returns an iterator over the versions returned by History,
+// downloading pages of at most pageSize versions concurrently before yielding
+// them (default: 1000)
+func (a *Archive) HistoryIter(ctx context.Context, latest []byte, pageSize int) history.Seq {
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	return func(yield func([]byte, error) bool) {
+		since, ok := history.Since(latest, a.settings)
+		if !ok {
+			return
+		}
+		keys := a.keys
+		if since != nil {
+			var err error
+			if keys, err = a.after(since); err != nil {
+				yield(nil, err)
+				return
+			}
+		}
+
+		for start := 0; start < len(keys); start += pageSize {
+			end := start + pageSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			page, err := a.download(ctx, keys[start:end])
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _, version := range page {
+				if !yield(version, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Has returns true if the given version has been archived
+func (a *Archive) Has(ctx context.Context, version []byte) (bool, error) {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return false, fmt.Errorf("error hashing version: %v", err)
+	}
+	_, ok := a.index[sum]
+	return ok, nil
+}
+
+// after returns the keys of the versions archived after the given version,
+// or nil if the version has not been archived
+func (a *Archive) after(latest []byte) ([]string, error) {
+	sum, err := canonical.Hash(latest)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing latest version: %v", err)
+	}
+	if _, ok := a.index[sum]; !ok {
+		return nil, nil
+	}
+	for i, key := range a.keys {
+		if _, s, _ := a.parse(key); s == sum {
+			return a.keys[i+1:], nil
+		}
+	}
+	return nil, nil
+}
+
+func (a *Archive) Put(ctx context.Context, versions ...[]byte) error {
+	var keys []string
+	var bodies [][]byte
+	added := make(map[[canonical.Size]byte]struct{}, len(versions))
+	for _, version := range versions {
+		sum, err := canonical.Hash(version)
+		if err != nil {
+			return fmt.Errorf("error hashing version: %v", err)
+		}
+		if _, ok := a.index[sum]; ok {
+			continue
+		}
+		if _, ok := added[sum]; ok {
+			continue
+		}
+		added[sum] = struct{}{}
+		keys = append(keys, a.key(ulid.Make(), sum))
+		bodies = append(bodies, version)
+	}
+
+	err := a.parallel(ctx, len(keys), func(ctx context.Context, i int) error {
+		_, err := a.s3.PutObject(ctx, &awss3.PutObjectInput{
+			Bucket:      &a.cfg.Bucket,
+			Key:         &keys[i],
+			Body:        bytes.NewReader(bodies[i]),
+			ContentType: aws.String("application/json"),
+		})
+		if err != nil {
+			return fmt.Errorf("error uploading version %s: %v", keys[i], err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		_, sum, _ := a.parse(key)
+		a.index[sum] = []string{key}
+	}
+	a.keys = append(a.keys, keys...)
+	return a.prune(ctx)
+}
+
+// PutMetadata archives a version along with its metadata, which is persisted
+// as a separate object keyed by canonical version hash
+func (a *Archive) PutMetadata(ctx context.Context, version []byte, metadata []history.Metadata) error {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return fmt.Errorf("error hashing version: %v", err)
+	}
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("error serializing metadata: %v", err)
+	}
+	key := a.metadataKey(sum)
+	_, err = a.s3.PutObject(ctx, &awss3.PutObjectInput{
+		Bucket:      &a.cfg.Bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading metadata %s: %v", key, err)
+	}
+	return a.Put(ctx, version)
+}
+
+// Metadata returns the metadata archived alongside the given version
+func (a *Archive) Metadata(ctx context.Context, version []byte) ([]history.Metadata, error) {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing version: %v", err)
+	}
+	key := a.metadataKey(sum)
+	resp, err := a.s3.GetObject(ctx, &awss3.GetObjectInput{
+		Bucket: &a.cfg.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var notFound *types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error downloading metadata %s: %v", key, err)
+	}
+	defer resp.Body.Close()
+
+	var metadata []history.Metadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("error parsing metadata %s: %v", key, err)
+	}
+	return metadata, nil
+}
+
+// download retrieves the versions with the given object keys, in order
+func (a *Archive) download(ctx context.Context, keys []string) ([][]byte, error) {
+	versions := make([][]byte, len(keys))
+	err := a.parallel(ctx, len(keys), func(ctx context.Context, i int) error {
+		resp, err := a.s3.GetObject(ctx, &awss3.GetObjectInput{
+			Bucket: &a.cfg.Bucket,
+			Key:    &keys[i],
+		})
+		if err != nil {
+			return fmt.Errorf("error downloading version %s: %v", keys[i], err)
+		}
+		defer resp.Body.Close()
+
+		if versions[i], err = io.ReadAll(resp.Body); err != nil {
+			return fmt.Errorf("error reading version %s: %v", keys[i], err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// prune deletes the oldest version objects according to the configured
+// retention policy, using the timestamp embedded in each object key
+func (a *Archive) prune(ctx context.Context) error {
+	retention := a.settings.Retention
+	if retention == nil {
+		return nil
+	}
+
+	archived := make([]time.Time, len(a.keys))
+	for i, key := range a.keys {
+		id, _, _ := a.parse(key)
+		archived[i] = ulid.Time(id.Time())
+	}
+	n := retention.Prune(time.Now(), archived)
+	if n == 0 {
+		return nil
+	}
+	if retention.DryRun {
+		pruned, err := a.download(ctx, a.keys[:n])
+		if err != nil {
+			return err
+		}
+		retention.Report(pruned)
+		return nil
+	}
+
+	if err := a.remove(ctx, a.objects(a.keys[:n])); err != nil {
+		return fmt.Errorf("error pruning versions: %v", err)
+	}
+	a.keys = a.keys[n:]
+	return nil
+}
+
+// List returns all versions along with the time each was archived, using the
+// timestamp embedded in each object key
+func (a *Archive) List(ctx context.Context) ([]history.Entry, error) {
+	versions, err := a.download(ctx, a.keys)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]history.Entry, len(versions))
+	for i, version := range versions {
+		id, _, _ := a.parse(a.keys[i])
+		entries[i] = history.Entry{Archived: ulid.Time(id.Time()), Version: version}
+	}
+	return entries, nil
+}
+
+// Delete removes the objects of the given versions
+func (a *Archive) Delete(ctx context.Context, versions ...[]byte) (int, error) {
+	targets := make(map[[canonical.Size]byte]struct{}, len(versions))
+	for _, version := range versions {
+		sum, err := canonical.Hash(version)
+		if err != nil {
+			return 0, fmt.Errorf("error hashing version: %v", err)
+		}
+		targets[sum] = struct{}{}
+	}
+
+	var removed, kept []string
+	for _, key := range a.keys {
+		_, sum, _ := a.parse(key)
+		if _, ok := targets[sum]; ok {
+			removed = append(removed, key)
+		} else {
+			kept = append(kept, key)
+		}
+	}
+	if err := a.remove(ctx, a.objects(removed)); err != nil {
+		return 0, fmt.Errorf("error deleting versions: %v", err)
+	}
+	a.keys = kept
+	return len(removed), nil
+}
+
+// remove deletes the given version objects, along with any metadata objects,
+// in batches and removes them from the version index
+func (a *Archive) remove(ctx context.Context, keys []string) error {
+	targets := make([]string, 0, len(keys)*2)
+	seen := make(map[[canonical.Size]byte]struct{}, len(keys))
+	for _, key := range keys {
+		targets = append(targets, key)
+		_, sum, _ := a.parse(key)
+		if _, ok := seen[sum]; !ok {
+			seen[sum] = struct{}{}
+			targets = append(targets, a.metadataKey(sum))
+		}
+	}
+
+	batches := (len(targets) + deleteBatchSize - 1) / deleteBatchSize
+	err := a.parallel(ctx, batches, func(ctx context.Context, i int) error {
+		batch := targets[i*deleteBatchSize:]
+		if len(batch) > deleteBatchSize {
+			batch = batch[:deleteBatchSize]
+		}
+		objects := make([]types.ObjectIdentifier, len(batch))
+		for j := range batch {
+			objects[j] = types.ObjectIdentifier{Key: &batch[j]}
+		}
+		resp, err := a.s3.DeleteObjects(ctx, &awss3.DeleteObjectsInput{
+			Bucket: &a.cfg.Bucket,
+			Delete: &types.Delete{Objects: objects, Quiet: true},
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Errors) > 0 {
+			return fmt.Errorf("error deleting %s: %s", aws.ToString(resp.Errors[0].Key), aws.ToString(resp.Errors[0].Message))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		_, sum, _ := a.parse(key)
+		delete(a.index, sum)
+	}
+	return nil
+}
+
+// objects returns the keys of every object archived for the versions with the
+// given object keys, including duplicates archived by concurrent writers
+func (a *Archive) objects(keys []string) []string {
+	objects := make([]string, 0, len(keys))
+	for _, key := range keys {
+		_, sum, _ := a.parse(key)
+		if dups, ok := a.index[sum]; ok {
+			objects = append(objects, dups...)
+		} else {
+			objects = append(objects, key)
+		}
+	}
+	return objects
+}
+
+// key returns the object key for a version with the given id and hash
+func (a *Archive) key(id ulid.ULID, sum [canonical.Size]byte) string {
+	return path.Join(a.cfg.Prefix, id.String()+"-"+hex.EncodeToString(sum[:])+objectExt)
+}
+
+// metadataKey returns the object key for the metadata of the version with the
+// given hash
+func (a *Archive) metadataKey(sum [canonical.Size]byte) string {
+	return path.Join(a.cfg.Prefix, metadataPrefix, hex.EncodeToString(sum[:])+objectExt)
+}
+
+// list populates the ordered list of version object keys and the version
+// index by listing all objects under the configured prefix
+func (a *Archive) list(ctx context.Context) error {
+	a.index = make(map[[canonical.Size]byte][]string)
+	a.keys = nil
+	prefix := a.cfg.Prefix + "/"
+	paginator := awss3.NewListObjectsV2Paginator(a.s3, &awss3.ListObjectsV2Input{
+		Bucket: &a.cfg.Bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("error listing versions: %v", err)
+		}
+		for _, obj := range page.Contents {
+			key := *obj.Key
+			_, sum, ok := a.parse(key)
+			if !ok {
+				continue
+			}
+			a.index[sum] = append(a.index[sum], key)
+		}
+	}
+	for _, keys := range a.index {
+		sort.Strings(keys)
+		a.keys = append(a.keys, keys[0])
+	}
+	sort.Strings(a.keys)
+	return nil
+}
+
+// parse extracts the version id and hash from a version object key,
+// returning false if the key is not a valid version object key
+func (a *Archive) parse(key string) (id ulid.ULID, sum [canonical.Size]byte, ok bool) {
+	name := strings.TrimSuffix(strings.TrimPrefix(key, a.cfg.Prefix+"/"), objectExt)
+	rawID, hash, ok := strings.Cut(name, "-")
+	if !ok || strings.Contains(name, "/") {
+		return id, sum, false
+	}
+	id, err := ulid.ParseStrict(rawID)
+	if err != nil {
+		return id, sum, false
+	}
+	if n, err := hex.Decode(sum[:], []byte(hash)); err != nil || n != canonical.Size {
+		return id, sum, false
+	}
+	return id, sum, true
+}
+
+// parallel invokes fn for each index in [0, n) using at most the configured
+// number of concurrent goroutines, returning the first error encountered
+func (a *Archive) parallel(ctx context.Context, n int, fn func(context.Context, int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var err error
+	sem := make(chan struct{}, a.cfg.Concurrency)
+	for i := 0; i < n; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if e := fn(ctx, i); e != nil {
+				once.Do(func() {
+					err = e
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
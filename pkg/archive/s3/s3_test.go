@@ -0,0 +1,301 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/internal/archivetest"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/internal/awsutil"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/lock"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchive(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	archivetest.Run(t, func(t *testing.T) archivetest.Opener {
+		ctx := context.Background()
+		cfg, _ := setup(t, ctx)
+		return func(s *settings.Settings) (archivetest.Archive, error) {
+			return New(ctx, cfg, s)
+		}
+	})
+}
+
+func TestArchiveRetention(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	ctx := context.Background()
+	cfg, s3client := setup(t, ctx)
+
+	// add an unrelated object under the prefix that should be ignored
+	_, err := s3client.PutObject(ctx, &awss3.PutObjectInput{
+		Bucket: &cfg.Bucket,
+		Key:    aws.String(cfg.Prefix + "/README.md"),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	a, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx,
+		[]byte(`{"id":"foo"}`),
+		[]byte(`{"id":"bar"}`),
+		[]byte(`{"id":"baz"}`),
+		[]byte(`{"id":"z"}`),
+		[]byte(`{"id":"x"}`),
+		[]byte(`{"id":"y"}`),
+		[]byte(`{"id":"a"}`),
+		[]byte(`{"id":"b"}`),
+	))
+
+	// dry run should not prune any versions
+	retention := &settings.Retention{DryRun: true, MaxVersions: 3}
+	b, err := New(ctx, cfg, &settings.Settings{Retention: retention})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, b.Put(ctx, []byte(`{"id":"c"}`)))
+	versions, err := b.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 9)
+
+	// oldest versions are pruned according to retention policy
+	retention.DryRun = false
+	assert.NoError(t, b.Put(ctx))
+	b, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	versions, err = b.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"id":"a"}`),
+		[]byte(`{"id":"b"}`),
+		[]byte(`{"id":"c"}`),
+	}, versions)
+}
+
+func TestArchiveDuplicates(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	ctx := context.Background()
+	cfg, s3client := setup(t, ctx)
+
+	a, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"a"}`), []byte(`{"id":"c"}`)))
+
+	// concurrent writers may archive the same version more than once, in which
+	// case every object is removed when the version is deleted or pruned
+	duplicate := func(version []byte) bool {
+		sum, err := canonical.Hash(version)
+		if !assert.NoError(t, err) {
+			return false
+		}
+		_, err = s3client.PutObject(ctx, &awss3.PutObjectInput{
+			Bucket: &cfg.Bucket,
+			Key:    aws.String(a.key(ulid.Make(), sum)),
+			Body:   bytes.NewReader(version),
+		})
+		return assert.NoError(t, err)
+	}
+	objects := func() (keys []string) {
+		resp, err := s3client.ListObjectsV2(ctx, &awss3.ListObjectsV2Input{
+			Bucket: &cfg.Bucket,
+			Prefix: aws.String(cfg.Prefix + "/"),
+		})
+		if assert.NoError(t, err) {
+			for _, obj := range resp.Contents {
+				if _, _, ok := a.parse(aws.ToString(obj.Key)); ok {
+					keys = append(keys, aws.ToString(obj.Key))
+				}
+			}
+		}
+		return keys
+	}
+	if !duplicate([]byte(`{"id":"a"}`)) || !duplicate([]byte(`{"id":"c"}`)) {
+		return
+	}
+	assert.Len(t, objects(), 4)
+	a, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"id":"a"}`),
+		[]byte(`{"id":"c"}`),
+	}, versions)
+	n, err := a.Delete(ctx, []byte(`{"id":"c"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Len(t, objects(), 2)
+	a, err = New(ctx, cfg, &settings.Settings{Retention: &settings.Retention{MaxVersions: 1}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"id":"e"}`)))
+	assert.Len(t, objects(), 1)
+	a, err = New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	versions, err = a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"id":"e"}`)}, versions)
+}
+
+func TestArchiveLock(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	ctx := context.Background()
+	cfg, _ := setup(t, ctx)
+
+	a, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := New(ctx, cfg, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the archive lock excludes other owners until released
+	lease, err := b.TryLock(ctx, lock.Request{Owner: "foo", TTL: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = a.TryLock(ctx, lock.Request{Owner: "bar", Steal: true, TTL: time.Minute})
+	var held *lock.HeldError
+	if assert.ErrorAs(t, err, &held) {
+		assert.Equal(t, "foo", held.Owner)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), held.Expires, 10*time.Second)
+	}
+	assert.NoError(t, b.Put(ctx, []byte(`{"id":"a"}`), []byte(`{"id":"c"}`)))
+	assert.NoError(t, lease.Release(ctx))
+
+	// expired leases are only stolen if permitted, after which the previous
+	// owner fails to release the lock
+	lease, err = b.TryLock(ctx, lock.Request{Owner: "foo", TTL: -time.Second})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = a.TryLock(ctx, lock.Request{Owner: "bar", TTL: time.Minute})
+	assert.ErrorAs(t, err, &held)
+	stolen, err := a.TryLock(ctx, lock.Request{Owner: "bar", Steal: true, TTL: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualError(t, lease.Release(ctx), "error releasing archive lock: lease expired and was stolen by bar")
+	assert.NoError(t, stolen.Release(ctx))
+
+	// acquiring the lock refreshes versions archived by the previous holder,
+	// and the lock object is not treated as a version
+	lease, err = a.TryLock(ctx, lock.Request{Owner: "bar", TTL: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"id":"a"}`),
+		[]byte(`{"id":"c"}`),
+	}, versions)
+	assert.NoError(t, lease.Release(ctx))
+
+	// leases are renewed until released, so that they are never stolen from a
+	// live holder
+	lease, err = a.TryLock(ctx, lock.Request{Owner: "bar", TTL: 600 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	time.Sleep(time.Second)
+	_, err = b.TryLock(ctx, lock.Request{Owner: "foo", Steal: true, TTL: time.Minute})
+	if assert.ErrorAs(t, err, &held) {
+		assert.Equal(t, "bar", held.Owner)
+	}
+	assert.NoError(t, lease.Release(ctx))
+}
+
+// setup creates a test bucket, which is emptied and removed when the test
+// completes, returning the archive config and an s3 client for inspecting
+// archived objects
+func setup(t *testing.T, ctx context.Context) (Config, *awss3.Client) {
+	id, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		t.Fatalf("error generating bucket id: %v", err)
+	}
+
+	cfg := Config{
+		Bucket:      fmt.Sprintf("test-%s", id.String()),
+		Concurrency: 2,
+		Endpoint:    "http://localhost:4566",
+		Region:      "us-east-1",
+		Prefix:      "my-team/my-pipeline/my-resource",
+		Credentials: &Credentials{
+			AccessKey: "abc",
+			SecretKey: "123",
+		},
+	}
+
+	// initialize test s3 client
+	s3client, err := awsutil.NewS3Client(ctx, awsutil.Config{
+		Credentials: cfg.Credentials,
+		Endpoint:    cfg.Endpoint,
+		Region:      cfg.Region,
+	})
+	if err != nil {
+		t.Fatalf("error initializing s3 client: %v", err)
+	}
+
+	// create test bucket
+	if _, err := s3client.CreateBucket(ctx, &awss3.CreateBucketInput{
+		Bucket: &cfg.Bucket,
+	}); err != nil {
+		t.Fatalf("error creating s3 bucket: %v", err)
+	}
+	t.Cleanup(func() {
+		objects, err := s3client.ListObjectsV2(ctx, &awss3.ListObjectsV2Input{
+			Bucket: &cfg.Bucket,
+		})
+		if assert.NoError(t, err) {
+			for _, obj := range objects.Contents {
+				_, err = s3client.DeleteObject(ctx, &awss3.DeleteObjectInput{
+					Bucket: &cfg.Bucket,
+					Key:    obj.Key,
+				})
+				assert.NoError(t, err)
+			}
+		}
+		_, err = s3client.DeleteBucket(ctx, &awss3.DeleteBucketInput{
+			Bucket: &cfg.Bucket,
+		})
+		assert.NoError(t, err)
+	})
+	return cfg, s3client
+}
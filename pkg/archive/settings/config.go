@@ -2,9 +2,29 @@ package settings
 
 // Settings describes common archive configuration common to all backends
 type Settings struct {
+	// Encryption describes an optional encryption at rest configuration, which encrypts
+	// each version before it is persisted by the configured backend
+	Encryption *Encryption `json:"encryption,omitempty" validate:"omitempty"`
 	// ForceHistory indicates that an archive should return all available history on Check
 	// regardless of whether or not a latest version is provided. This can be useful when
 	// pinned resources are orphaned in various situations (e.g. resource credentials are
 	// rotated)
 	ForceHistory bool `json:"force_history"`
+	// Incremental indicates that an archive should return only the versions archived after
+	// the latest version provided on Check, rather than nothing at all. This allows a
+	// resource whose Concourse version history was partially lost to be backfilled
+	// incrementally without replaying the entire archive. Mutually exclusive with
+	// ForceHistory
+	Incremental bool `json:"incremental" validate:"excluded_with=ForceHistory"`
+	// Lock describes how check and put steps lock archives that support coarse-grained
+	// locking, excluding concurrent writers while history is read and new versions are
+	// archived
+	Lock *Lock `json:"lock,omitempty" validate:"omitempty"`
+	// Namespace isolates the versions of a single resource within storage shared by
+	// many resources (e.g. a single boltdb object or database), and is derived by the
+	// sdk from the resource's identity source fields if not specified
+	Namespace string `json:"namespace,omitempty" validate:"omitempty,alphanum,max=32"`
+	// Retention describes an optional policy for pruning archived versions, which is
+	// enforced by every backend whenever new versions are archived
+	Retention *Retention `json:"retention,omitempty" validate:"omitempty"`
 }
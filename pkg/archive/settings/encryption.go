@@ -0,0 +1,21 @@
+package settings
+
+// Encryption describes encryption at rest for archived versions
+type Encryption struct {
+	// Keys used to encrypt and decrypt archived versions. The first key is used
+	// to encrypt new versions, while all keys are used to decrypt existing
+	// versions, allowing keys to be rotated by prepending a new key
+	Keys []EncryptionKey `json:"keys" validate:"required,min=1,dive"`
+}
+
+// EncryptionKey describes a single encryption key, specified either as a raw
+// key or as a passphrase and salt from which a key is derived
+type EncryptionKey struct {
+	// A base64 encoded 256-bit key
+	Key string `json:"key,omitempty" validate:"required_without=Passphrase,excluded_with=Passphrase"`
+	// A passphrase from which a 256-bit key is derived using argon2id
+	Passphrase string `json:"passphrase,omitempty" validate:"required_without=Key"`
+	// A random salt, unique to each archive, used when deriving a key from the
+	// passphrase
+	Salt string `json:"salt,omitempty" validate:"required_with=Passphrase,excluded_with=Key,omitempty,min=16"`
+}
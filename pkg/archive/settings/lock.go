@@ -0,0 +1,21 @@
+package settings
+
+// Lock describes how check and put steps acquire a coarse-grained lock on
+// archives that support locking, which is held while reading history,
+// archiving new versions, and closing the archive
+type Lock struct {
+	// Disabled disables locking, relying solely on each backend's handling of
+	// concurrent writes
+	Disabled bool `json:"disabled"`
+	// DisableSteal prevents taking over a lease that has expired without being
+	// released (e.g. by a step that was interrupted), in which case the lock
+	// must be removed manually
+	DisableSteal bool `json:"disable_steal"`
+	// TTL specifies the duration of a lease, after which it may be stolen by
+	// another step, and should exceed the duration of the longest check or put
+	// step (default: 10m)
+	TTL Duration `json:"ttl" validate:"min=0"`
+	// Wait specifies the maximum duration to wait for a lock held by another
+	// step before failing (default: 5m)
+	Wait Duration `json:"wait" validate:"min=0"`
+}
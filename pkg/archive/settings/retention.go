@@ -0,0 +1,61 @@
+package settings
+
+import (
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Retention describes a policy for pruning archived versions. Versions are
+// always pruned oldest first, so that the archive remains an ordered suffix of
+// a resource's version history.
+type Retention struct {
+	// DryRun reports the versions that would be pruned without removing them
+	DryRun bool `json:"dry_run"`
+	// KeepLast specifies the number of most recent versions that are always
+	// retained, regardless of MaxAge and MaxVersions
+	KeepLast int `json:"keep_last" validate:"min=0"`
+	// MaxAge prunes versions archived longer ago than the given duration
+	MaxAge Duration `json:"max_age" validate:"min=0"`
+	// MaxVersions limits the total number of archived versions
+	MaxVersions int `json:"max_versions" validate:"min=0"`
+}
+
+// Prune returns the number of oldest versions that should be pruned, given
+// the time at which each archived version was archived (ordered oldest
+// first). A zero time indicates that a version's archive time is unknown,
+// which is never considered expired.
+func (r *Retention) Prune(now time.Time, archived []time.Time) int {
+	if r == nil {
+		return 0
+	}
+
+	var n int
+	if r.MaxVersions > 0 && len(archived) > r.MaxVersions {
+		n = len(archived) - r.MaxVersions
+	}
+	if r.MaxAge > 0 {
+		cutoff := now.Add(-time.Duration(r.MaxAge))
+		for n < len(archived) && !archived[n].IsZero() && archived[n].Before(cutoff) {
+			n++
+		}
+	}
+	if keep := len(archived) - r.KeepLast; n > keep {
+		n = keep
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// Report logs the versions that would have been pruned during a dry run
+func (r *Retention) Report(versions [][]byte) {
+	if len(versions) == 0 {
+		return
+	}
+	color.Yellow("retention dry run: %d archived version(s) would be pruned", len(versions))
+	for _, v := range versions {
+		color.Yellow("  %s", v)
+	}
+}
@@ -0,0 +1,76 @@
+package settings
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionPrune(t *testing.T) {
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	archived := []time.Time{
+		now.Add(-72 * time.Hour),
+		now.Add(-48 * time.Hour),
+		now.Add(-24 * time.Hour),
+		now.Add(-time.Hour),
+		now,
+	}
+
+	cases := map[string]struct {
+		retention *Retention
+		archived  []time.Time
+		expected  int
+	}{
+		"nil": {
+			archived: archived,
+			expected: 0,
+		},
+		"empty": {
+			retention: &Retention{},
+			archived:  archived,
+			expected:  0,
+		},
+		"max_versions": {
+			retention: &Retention{MaxVersions: 2},
+			archived:  archived,
+			expected:  3,
+		},
+		"max_versions_not_exceeded": {
+			retention: &Retention{MaxVersions: 10},
+			archived:  archived,
+			expected:  0,
+		},
+		"max_age": {
+			retention: &Retention{MaxAge: Duration(36 * time.Hour)},
+			archived:  archived,
+			expected:  2,
+		},
+		"max_age_and_max_versions": {
+			retention: &Retention{MaxAge: Duration(36 * time.Hour), MaxVersions: 2},
+			archived:  archived,
+			expected:  3,
+		},
+		"keep_last": {
+			retention: &Retention{KeepLast: 4, MaxAge: Duration(time.Minute), MaxVersions: 1},
+			archived:  archived,
+			expected:  1,
+		},
+		"keep_last_exceeds_total": {
+			retention: &Retention{KeepLast: 10, MaxVersions: 1},
+			archived:  archived,
+			expected:  0,
+		},
+		"unknown_archive_time": {
+			retention: &Retention{MaxAge: Duration(time.Minute)},
+			archived:  []time.Time{archived[0], {}, archived[2]},
+			expected:  1,
+		},
+	}
+
+	for desc, c := range cases {
+		t.Run(desc, func(t *testing.T) {
+			assert.Equal(t, c.expected, c.retention.Prune(now, c.archived))
+		})
+	}
+}
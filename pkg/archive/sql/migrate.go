@@ -0,0 +1,126 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialect describes driver specific query syntax and schema migrations
+type dialect struct {
+	// bind returns the positional parameter placeholder for the nth argument
+	bind func(n int) string
+	// lock, if non-empty, is executed at the start of each transaction that
+	// archives versions, serializing writers so that sequences are committed
+	// in order and incremental history never skips a concurrently committed
+	// version
+	lock string
+	// maxOpenConns limits the number of open connections, if non-zero
+	maxOpenConns int
+	// migrations contains an ordered list of schema migrations, which must
+	// never be modified once released
+	migrations []string
+}
+
+var dialects = map[string]*dialect{
+	"postgres": {
+		bind: func(n int) string {
+			return "$" + strconv.Itoa(n)
+		},
+		// permits concurrent reads while excluding other writers
+		lock: "LOCK TABLE {table} IN SHARE ROW EXCLUSIVE MODE",
+		migrations: []string{
+			`CREATE TABLE IF NOT EXISTS {table} (
+				seq BIGSERIAL PRIMARY KEY,
+				hash TEXT NOT NULL UNIQUE,
+				version TEXT NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL
+			)`,
+			`ALTER TABLE {table} ADD COLUMN metadata TEXT`,
+		},
+	},
+	"sqlite": {
+		bind: func(int) string {
+			return "?"
+		},
+		maxOpenConns: 1,
+		migrations: []string{
+			`CREATE TABLE IF NOT EXISTS {table} (
+				seq INTEGER PRIMARY KEY AUTOINCREMENT,
+				hash TEXT NOT NULL UNIQUE,
+				version TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			)`,
+			`ALTER TABLE {table} ADD COLUMN metadata TEXT`,
+		},
+	},
+}
+
+var placeholder = regexp.MustCompile(`\{(\d+)\}`)
+
+// query renders a query template, replacing {table} with the given table name
+// and {n} with the dialect's placeholder for the nth argument
+func (d *dialect) query(table, q string) string {
+	q = strings.ReplaceAll(q, "{table}", table)
+	return placeholder.ReplaceAllStringFunc(q, func(s string) string {
+		n, _ := strconv.Atoi(s[1 : len(s)-1])
+		return d.bind(n)
+	})
+}
+
+// migrate applies any outstanding schema migrations, tracking applied
+// migrations in a separate table
+func (a *Archive) migrate(ctx context.Context) error {
+	if a.dialect.maxOpenConns > 0 {
+		a.db.SetMaxOpenConns(a.dialect.maxOpenConns)
+	}
+
+	migrations := a.cfg.Table + "_migrations"
+	_, err := a.db.ExecContext(ctx, a.dialect.query(migrations, "CREATE TABLE IF NOT EXISTS {table} (version INTEGER PRIMARY KEY, applied_at TIMESTAMP NOT NULL)"))
+	if err != nil {
+		return fmt.Errorf("error creating migrations table: %v", err)
+	}
+
+	for {
+		var current int
+		err := a.db.QueryRowContext(ctx, a.dialect.query(migrations, "SELECT COALESCE(MAX(version), 0) FROM {table}")).Scan(&current)
+		if err != nil {
+			return fmt.Errorf("error retrieving schema version: %v", err)
+		}
+		if current >= len(a.dialect.migrations) {
+			return nil
+		}
+
+		// apply the next migration, tolerating concurrent migrations by
+		// re-checking the schema version on failure
+		if err := a.apply(ctx, migrations, current+1); err != nil {
+			var latest int
+			if rerr := a.db.QueryRowContext(ctx, a.dialect.query(migrations, "SELECT COALESCE(MAX(version), 0) FROM {table}")).Scan(&latest); rerr != nil || latest <= current {
+				return err
+			}
+		}
+	}
+}
+
+// apply executes a single schema migration within a transaction
+func (a *Archive) apply(ctx context.Context, migrations string, version int) error {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning migration transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, a.dialect.query(a.cfg.Table, a.dialect.migrations[version-1])); err != nil {
+		return fmt.Errorf("error applying migration %d: %v", version, err)
+	}
+	if _, err := tx.ExecContext(ctx, a.dialect.query(migrations, "INSERT INTO {table} (version, applied_at) VALUES ({1}, {2})"), version, time.Now().UTC()); err != nil {
+		return fmt.Errorf("error recording migration %d: %v", version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing migration %d: %v", version, err)
+	}
+	return nil
+}
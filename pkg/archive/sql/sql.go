@@ -0,0 +1,409 @@
+// Package sql implements a resource version archive persisted to a SQL
+// database, supporting SQLite (for local and test use) and PostgreSQL.
+package sql
+
+import (
+	"context"
+	stdsql "database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/cludden/concourse-go-sdk/pkg/archive"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/history"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+
+	// register supported database drivers
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	archive.Register("sql", archive.NewFactory(New))
+}
+
+const (
+	defaultPageSize = 1000
+	defaultTable    = "concourse_versions"
+)
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Config describes the available resource-specific configuration settings
+type Config struct {
+	// The database driver, one of: sqlite, postgres
+	Driver string `json:"driver" validate:"required,oneof=sqlite postgres"`
+	// The driver specific data source name (e.g. a file path for sqlite, or a
+	// connection string for postgres)
+	DSN string `json:"dsn" validate:"required"`
+	// The number of versions to read per query when retrieving history
+	// (default: 1000)
+	PageSize int `json:"page_size" validate:"omitempty,min=1"`
+	// The name of the table used to persist versions (default:
+	// concourse_versions), which is suffixed with the namespace if configured
+	Table string `json:"table"`
+}
+
+// Archive implements a resource version archive using a SQL database, where
+// each version is persisted as a row with a unique canonical hash and an
+// auto-incrementing sequence that preserves insertion order. Writers are
+// serialized where the database would otherwise commit sequences out of order.
+type Archive struct {
+	cfg      *Config
+	db       *stdsql.DB
+	dialect  *dialect
+	settings *settings.Settings
+}
+
+func New(ctx context.Context, cfg Config, s *settings.Settings) (*Archive, error) {
+	if cfg.PageSize <= 0 {
+		cfg.PageSize = defaultPageSize
+	}
+	if cfg.Table == "" {
+		cfg.Table = defaultTable
+	}
+	if s.Namespace != "" {
+		cfg.Table += "_" + s.Namespace
+	}
+	if !identifier.MatchString(cfg.Table) {
+		return nil, fmt.Errorf("invalid table name: %s", cfg.Table)
+	}
+
+	d, ok := dialects[cfg.Driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported driver: %s", cfg.Driver)
+	}
+
+	db, err := stdsql.Open(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+
+	a := &Archive{cfg: &cfg, db: db, dialect: d, settings: s}
+	if err := a.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Archive) Close(ctx context.Context) error {
+	if err := a.db.Close(); err != nil {
+		return fmt.Errorf("error closing database: %v", err)
+	}
+	return nil
+}
+
+func (a *Archive) History(ctx context.Context, latest []byte) ([][]byte, error) {
+	return history.Collect(a.HistoryIter(ctx, latest, 0))
+}
+
+// HistoryIter returns an iterator over the versions returned by History,
+// reading at most pageSize versions per query (default: the configured page
+// size)
+func (a *Archive) HistoryIter(ctx context.Context, latest []byte, pageSize int) history.Seq {
+	if pageSize <= 0 {
+		pageSize = a.cfg.PageSize
+	}
+	return func(yield func([]byte, error) bool) {
+		since, ok := history.Since(latest, a.settings)
+		if !ok {
+			return
+		}
+		var cursor int64
+		if since != nil {
+			seq, err := a.seq(ctx, since)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if seq == 0 {
+				return
+			}
+			cursor = seq
+		}
+
+		// read versions in pages ordered by sequence
+		q := a.dialect.query(a.cfg.Table, "SELECT seq, version FROM {table} WHERE seq > {1} ORDER BY seq LIMIT {2}")
+		for {
+			page, err := a.page(ctx, q, &cursor, pageSize)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _, version := range page {
+				if !yield(version, nil) {
+					return
+				}
+			}
+			if len(page) < pageSize {
+				return
+			}
+		}
+	}
+}
+
+func (a *Archive) Put(ctx context.Context, versions ...[]byte) error {
+	return a.put(ctx, versions, nil)
+}
+
+// PutMetadata archives a version along with its metadata, replacing the
+// metadata of a previously archived version
+func (a *Archive) PutMetadata(ctx context.Context, version []byte, metadata []history.Metadata) error {
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("error serializing metadata: %v", err)
+	}
+	s := string(b)
+	return a.put(ctx, [][]byte{version}, &s)
+}
+
+// Metadata returns the metadata archived alongside the given version
+func (a *Archive) Metadata(ctx context.Context, version []byte) ([]history.Metadata, error) {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing version: %v", err)
+	}
+	var raw stdsql.NullString
+	err = a.db.QueryRowContext(ctx, a.dialect.query(a.cfg.Table, "SELECT metadata FROM {table} WHERE hash = {1}"), hex.EncodeToString(sum[:])).Scan(&raw)
+	if errors.Is(err, stdsql.ErrNoRows) || (err == nil && !raw.Valid) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying metadata: %v", err)
+	}
+	var metadata []history.Metadata
+	if err := json.Unmarshal([]byte(raw.String), &metadata); err != nil {
+		return nil, fmt.Errorf("error parsing metadata: %v", err)
+	}
+	return metadata, nil
+}
+
+// put inserts versions that have not previously been archived within a single
+// transaction, replacing the metadata of each version if metadata is non-nil
+func (a *Archive) put(ctx context.Context, versions [][]byte, metadata *string) error {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if a.dialect.lock != "" {
+		if _, err := tx.ExecContext(ctx, a.dialect.query(a.cfg.Table, a.dialect.lock)); err != nil {
+			return fmt.Errorf("error locking table: %v", err)
+		}
+	}
+
+	q := a.dialect.query(a.cfg.Table, "INSERT INTO {table} (hash, version, created_at) VALUES ({1}, {2}, {3}) ON CONFLICT (hash) DO NOTHING")
+	if metadata != nil {
+		q = a.dialect.query(a.cfg.Table, "INSERT INTO {table} (hash, version, created_at, metadata) VALUES ({1}, {2}, {3}, {4}) ON CONFLICT (hash) DO UPDATE SET metadata = excluded.metadata")
+	}
+	stmt, err := tx.PrepareContext(ctx, q)
+	if err != nil {
+		return fmt.Errorf("error preparing statement: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, version := range versions {
+		normalized, err := canonical.Normalize(version)
+		if err != nil {
+			return fmt.Errorf("error normalizing version: %v", err)
+		}
+		sum, err := canonical.Hash(normalized)
+		if err != nil {
+			return fmt.Errorf("error hashing version: %v", err)
+		}
+		args := []any{hex.EncodeToString(sum[:]), string(normalized), time.Now().UTC()}
+		if metadata != nil {
+			args = append(args, *metadata)
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return fmt.Errorf("error inserting version: %v", err)
+		}
+	}
+
+	if err := a.prune(ctx, tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+	return nil
+}
+
+// List returns all versions along with the time each was archived
+func (a *Archive) List(ctx context.Context) ([]history.Entry, error) {
+	rows, err := a.db.QueryContext(ctx, a.dialect.query(a.cfg.Table, "SELECT created_at, version FROM {table} ORDER BY seq"))
+	if err != nil {
+		return nil, fmt.Errorf("error querying versions: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []history.Entry
+	for rows.Next() {
+		var created time.Time
+		var version string
+		if err := rows.Scan(&created, &version); err != nil {
+			return nil, fmt.Errorf("error scanning version: %v", err)
+		}
+		entries = append(entries, history.Entry{Archived: created, Version: []byte(version)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading versions: %v", err)
+	}
+	return entries, nil
+}
+
+// Delete removes the given versions within a single transaction
+func (a *Archive) Delete(ctx context.Context, versions ...[]byte) (int, error) {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, a.dialect.query(a.cfg.Table, "DELETE FROM {table} WHERE hash = {1}"))
+	if err != nil {
+		return 0, fmt.Errorf("error preparing statement: %v", err)
+	}
+	defer stmt.Close()
+
+	var n int64
+	for _, version := range versions {
+		sum, err := canonical.Hash(version)
+		if err != nil {
+			return 0, fmt.Errorf("error hashing version: %v", err)
+		}
+		result, err := stmt.ExecContext(ctx, hex.EncodeToString(sum[:]))
+		if err != nil {
+			return 0, fmt.Errorf("error deleting version: %v", err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("error deleting version: %v", err)
+		}
+		n += affected
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing transaction: %v", err)
+	}
+	return int(n), nil
+}
+
+// Has returns true if the given version has been archived
+func (a *Archive) Has(ctx context.Context, version []byte) (bool, error) {
+	seq, err := a.seq(ctx, version)
+	return seq > 0, err
+}
+
+// seq returns the sequence of the given version, or 0 if the version has not
+// been archived
+func (a *Archive) seq(ctx context.Context, version []byte) (seq int64, err error) {
+	sum, err := canonical.Hash(version)
+	if err != nil {
+		return 0, fmt.Errorf("error hashing latest version: %v", err)
+	}
+	err = a.db.QueryRowContext(ctx, a.dialect.query(a.cfg.Table, "SELECT seq FROM {table} WHERE hash = {1}"), hex.EncodeToString(sum[:])).Scan(&seq)
+	if errors.Is(err, stdsql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error querying latest version: %v", err)
+	}
+	return seq, nil
+}
+
+// prune deletes the oldest versions according to the configured retention
+// policy within the given transaction
+func (a *Archive) prune(ctx context.Context, tx *stdsql.Tx) error {
+	retention := a.settings.Retention
+	if retention == nil {
+		return nil
+	}
+
+	rows, err := tx.QueryContext(ctx, a.dialect.query(a.cfg.Table, "SELECT seq, created_at FROM {table} ORDER BY seq"))
+	if err != nil {
+		return fmt.Errorf("error querying versions: %v", err)
+	}
+	defer rows.Close()
+
+	var seqs []int64
+	var archived []time.Time
+	for rows.Next() {
+		var seq int64
+		var created time.Time
+		if err := rows.Scan(&seq, &created); err != nil {
+			return fmt.Errorf("error scanning version: %v", err)
+		}
+		seqs = append(seqs, seq)
+		archived = append(archived, created)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading versions: %v", err)
+	}
+	rows.Close()
+
+	n := retention.Prune(time.Now(), archived)
+	if n == 0 {
+		return nil
+	}
+	if retention.DryRun {
+		return a.report(ctx, tx, seqs[n-1])
+	}
+
+	if _, err := tx.ExecContext(ctx, a.dialect.query(a.cfg.Table, "DELETE FROM {table} WHERE seq <= {1}"), seqs[n-1]); err != nil {
+		return fmt.Errorf("error pruning versions: %v", err)
+	}
+	return nil
+}
+
+// report logs the versions with a sequence less than or equal to the given
+// cutoff, which would have been pruned during a dry run
+func (a *Archive) report(ctx context.Context, tx *stdsql.Tx, cutoff int64) error {
+	rows, err := tx.QueryContext(ctx, a.dialect.query(a.cfg.Table, "SELECT version FROM {table} WHERE seq <= {1} ORDER BY seq"), cutoff)
+	if err != nil {
+		return fmt.Errorf("error querying versions: %v", err)
+	}
+	defer rows.Close()
+
+	var pruned [][]byte
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return fmt.Errorf("error scanning version: %v", err)
+		}
+		pruned = append(pruned, []byte(version))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading versions: %v", err)
+	}
+	a.settings.Retention.Report(pruned)
+	return nil
+}
+
+// page reads a single page of at most n versions with a sequence greater than
+// cursor, advancing the cursor
+func (a *Archive) page(ctx context.Context, q string, cursor *int64, n int) (page [][]byte, err error) {
+	rows, err := a.db.QueryContext(ctx, q, *cursor, n)
+	if err != nil {
+		return nil, fmt.Errorf("error querying versions: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(cursor, &version); err != nil {
+			return nil, fmt.Errorf("error scanning version: %v", err)
+		}
+		page = append(page, []byte(version))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading versions: %v", err)
+	}
+	return page, nil
+}
@@ -2,7 +2,6 @@ package sdk
 
 import (
 	"context"
-	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +9,11 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"time"
 
+	"github.com/cludden/concourse-go-sdk/pkg/archive"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/canonical"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
 	"github.com/fatih/color"
 	"github.com/hashicorp/go-multierror"
 	"github.com/tidwall/gjson"
@@ -33,29 +36,55 @@ type (
 	// Op implements an enumeration of supported resource operations
 	Op int
 
-	// Resource describes a Concourse custom resource implementation
-	Resource[Source any, Version any, GetParams any, PutParams any] interface {
-		// Archive intializes an Archive implementation for persisting resource
-		// version history outside of Concourse
+	// Archiver describes a resource that initializes a custom Archive
+	// implementation for persisting resource version history outside of
+	// Concourse
+	Archiver[Source any] interface {
 		Archive(context.Context, *Source) (Archive, error)
+	}
 
+	// Checker describes a resource that supports check operations
+	Checker[Source any, Version any] interface {
 		// Check checks for new versions
 		Check(context.Context, *Source, *Version) ([]Version, error)
+	}
 
-		// Close is called after any Check/In/Out operation
+	// Closer describes a resource that performs cleanup after any
+	// Check/In/Out operation
+	Closer interface {
 		Close(context.Context) error
+	}
 
+	// Getter describes a resource that supports get steps
+	Getter[Source any, Version any, GetParams any] interface {
 		// In fetches the specified version and writes it to the filesystem
 		In(context.Context, *Source, *Version, string, *GetParams) ([]Metadata, error)
+	}
 
-		// Initialize is called prior to any Check/In/Out operation and provides
-		// an opportunity to perform common resource initialization logic
+	// Initializer describes a resource that performs common initialization
+	// logic prior to any Check/In/Out operation
+	Initializer[Source any] interface {
 		Initialize(context.Context, *Source) error
+	}
 
+	// Putter describes a resource that supports put steps
+	Putter[Source any, Version any, PutParams any] interface {
 		// Out creates a new resource version
 		Out(context.Context, *Source, string, *PutParams) (Version, []Metadata, error)
 	}
 
+	// Resource describes a Concourse custom resource implementation, which must
+	// implement the Checker, Getter, and Putter interfaces. Resources that do
+	// not support an operation embed UnsupportedCheck, UnsupportedGet, or
+	// UnsupportedPut in place of the corresponding method. The optional
+	// Initializer, Closer, and Archiver interfaces are detected individually at
+	// runtime.
+	Resource[Source any, Version any, GetParams any, PutParams any] interface {
+		Checker[Source, Version]
+		Getter[Source, Version, GetParams]
+		Putter[Source, Version, PutParams]
+	}
+
 	// Reponse describes a in/out response payload
 	Response[Version any] struct {
 		Version  *Version   `json:"version"`
@@ -80,6 +109,21 @@ const (
 	OutOp
 )
 
+// String returns the name of the operation as seen by Concourse (e.g. "put"
+// for OutOp)
+func (op Op) String() string {
+	switch op {
+	case CheckOp:
+		return "check"
+	case InOp:
+		return "get"
+	case OutOp:
+		return "put"
+	default:
+		return "invalid"
+	}
+}
+
 // Main executes a Concourse custom resource operation
 func Main[Source any, Version any, GetParams any, PutParams any](r Resource[Source, Version, GetParams, PutParams]) {
 	var op Op
@@ -114,6 +158,11 @@ func Exec[Source any, Version any, GetParams any, PutParams any](
 	stdout, stderr io.Writer,
 	args []string,
 ) (err error) {
+	// verify the resource supports the requested operation
+	if err := supports(op, r); err != nil {
+		return err
+	}
+
 	// blah, configure global color settings
 	color.NoColor = false
 	color.Output = stderr
@@ -145,14 +194,29 @@ func Exec[Source any, Version any, GetParams any, PutParams any](
 
 	req, errs := gjson.ParseBytes(payload), multierror.Append(nil)
 
+	// parse common sdk options
+	opts, err := parseOptions(req.Get("source"))
+	if err != nil {
+		return err
+	}
+	if opts.Color != nil {
+		color.NoColor = !*opts.Color
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(opts.Timeout))
+		defer cancel()
+	}
+	ctx = ContextWithOptions(ctx, opts)
+	Debugf(ctx, "executing %s operation", op)
+
 	// parse source
 	var source *Source
 	if x := req.Get("source"); x.Exists() && x.Type != gjson.Null {
-		var s Source
-		if err := json.Unmarshal([]byte(x.Raw), &s); err != nil {
+		if s, err := decode[Source](ctx, x, archiveKey, sdkKey); err != nil {
 			errs = multierror.Append(errs, fmt.Errorf("error parsing source: %w", err))
 		} else {
-			source = &s
+			source = s
 		}
 	}
 
@@ -168,11 +232,10 @@ func Exec[Source any, Version any, GetParams any, PutParams any](
 	// parse version
 	var version *Version
 	if x := req.Get("version"); x.Exists() && x.Type != gjson.Null {
-		var v Version
-		if err := json.Unmarshal([]byte(x.Raw), &v); err != nil {
+		if v, err := decode[Version](ctx, x); err != nil {
 			errs = multierror.Append(errs, fmt.Errorf("error parsing version: %w", err))
 		} else {
-			version = &v
+			version = v
 		}
 	}
 
@@ -190,40 +253,75 @@ func Exec[Source any, Version any, GetParams any, PutParams any](
 	}
 
 	// call Initialize method if defined
-	if err := r.Initialize(ctx, source); err != nil {
-		return fmt.Errorf("error initializing resource: %w", err)
-	}
-	defer func() {
-		if err := r.Close(ctx); err != nil {
-			color.Red("error closing resource: %v", err)
+	if i, ok := r.(Initializer[Source]); ok {
+		if err := i.Initialize(ctx, source); err != nil {
+			return fmt.Errorf("error initializing resource: %w", err)
 		}
-	}()
+	}
+	if c, ok := r.(Closer); ok {
+		defer func() {
+			if err := c.Close(ctx); err != nil {
+				color.Red("error closing resource: %v", err)
+			}
+		}()
+	}
 
-	// initialize archive
+	// initialize archive, which is only required by get steps when returning
+	// archived metadata
 	var archiver Archive
-	if op == CheckOp || op == OutOp {
-		archiver, err = r.Archive(ctx, source)
+	if op == CheckOp || op == OutOp || (op == InOp && opts.ArchivedMetadata) {
+		var adopt func(context.Context) error
+		archiver, adopt, err = newArchive(ctx, r, source, opts.Archive)
 		if err != nil {
 			return fmt.Errorf("error initializing archive: %w", err)
 		}
 		if archiver != nil {
+			// check and put steps hold the archive lock, if supported, until
+			// the archive is closed
+			var lease archive.Lease
+			if op != InOp {
+				var cfg *settings.Lock
+				if opts.Archive != nil {
+					cfg = opts.Archive.Lock
+				}
+				if lease, err = archive.Lock(ctx, archiver, cfg); err != nil {
+					if err := archiver.Close(ctx); err != nil {
+						color.Red("error closing archive: %v", err)
+					}
+					return fmt.Errorf("error locking archive: %w", err)
+				}
+			}
 			defer func() {
 				if err := archiver.Close(ctx); err != nil {
 					color.Red("error closing archive: %v", err)
 				}
+				if lease != nil {
+					if err := lease.Release(ctx); err != nil {
+						color.Red("error releasing archive lock: %v", err)
+					}
+				}
 			}()
+
+			// history archived before the resource identity was introduced is
+			// copied into its namespace by check and put steps, while holding
+			// the archive lock
+			if adopt != nil && op != InOp {
+				if err := adopt(ctx); err != nil {
+					return fmt.Errorf("error initializing archive: %w", err)
+				}
+			}
 		}
 	}
 
-	// execute Step
+	// execute Step, streaming check responses directly to stdout
 	var resp any
 	switch op {
 	case CheckOp:
-		resp, err = check(ctx, r, archiver, source, version)
+		return check[Source, Version](ctx, r, archiver, source, version, stdout)
 	case InOp:
-		resp, err = in(ctx, r, source, version, path, req.Get("params"))
+		resp, err = in[Source, Version, GetParams](ctx, r, archiver, source, version, path, req.Get("params"))
 	case OutOp:
-		resp, err = out(ctx, r, archiver, source, path, req.Get("params"))
+		resp, err = out[Source, Version, PutParams](ctx, r, archiver, source, path, req.Get("params"))
 	}
 	if err != nil {
 		return err
@@ -236,92 +334,156 @@ func Exec[Source any, Version any, GetParams any, PutParams any](
 	return nil
 }
 
-// check executs a Check operation on the provided resource
-func check[S any, V any, G any, P any](ctx context.Context, r Resource[S, V, G, P], archiver Archive, source *S, version *V) ([]V, error) {
-	// attempt to populate latest version for check operations if no existing version provided
-	// and archive is configured
-	var history [][]byte
-	var historyLength int
-	var err error
+// supports returns an error if the provided resource embeds the Unsupported
+// type corresponding to the given operation
+func supports(op Op, r any) error {
+	var unsupported bool
+	switch op {
+	case CheckOp:
+		_, unsupported = r.(interface{ checkUnsupported() })
+	case InOp:
+		_, unsupported = r.(interface{ getUnsupported() })
+	case OutOp:
+		_, unsupported = r.(interface{ putUnsupported() })
+	default:
+		return fmt.Errorf("invalid operation: %d", op)
+	}
+	if unsupported {
+		return errUnsupported(op)
+	}
+	return nil
+}
+
+// check executes a Check operation on the provided resource, streaming the
+// resulting versions to w as a json array
+func check[S any, V any](ctx context.Context, r Checker[S, V], archiver Archive, source *S, version *V, w io.Writer) error {
+	// versions are spooled until the response is complete, so that failed
+	// checks never write a partial response
+	out, err := newArrayWriter(w)
+	if err != nil {
+		return err
+	}
+	defer out.Discard()
+
+	// keep track of versions written, so that each version is written once,
+	// decoding serialized versions if v is nil
+	seen := make(map[[canonical.Size]byte]struct{})
+	write := func(serialized []byte, v *V) (bool, error) {
+		sum, err := canonical.Hash(serialized)
+		if err != nil {
+			return false, err
+		}
+		if _, ok := seen[sum]; ok {
+			return false, nil
+		}
+		if v == nil {
+			v = new(V)
+			if err := json.Unmarshal(serialized, v); err != nil {
+				return false, err
+			}
+		}
+		seen[sum] = struct{}{}
+		return true, out.Write(v)
+	}
+
+	// stream any archived history to the response, and attempt to populate
+	// latest version for check operations if no existing version provided
 	if archiver != nil {
 		color.Yellow("fetching archived resource version history...")
 
 		var latest []byte
+		var err error
 		if version != nil {
-			latest, err = json.Marshal(version)
+			latest, err = canonical.Marshal(version)
 			if err != nil {
-				return nil, fmt.Errorf("error fetching archive history: error serializing latest version: %w", err)
+				return fmt.Errorf("error fetching archive history: error serializing latest version: %w", err)
 			}
 		}
 
-		history, err = archiver.History(ctx, latest)
+		// incremental history only contains versions archived after the latest
+		// version, which must precede them
+		opts := OptionsFromContext(ctx)
+		incremental := version != nil && opts != nil && opts.Archive != nil && opts.Archive.Incremental
+
+		var historyLatest []byte
+		var historyLength int
+		archive.HistoryIter(ctx, archiver, latest, 0)(func(v []byte, e error) bool {
+			if e != nil {
+				err = fmt.Errorf("error hydrating archived version history: %w", e)
+				return false
+			}
+			if historyLength == 0 && incremental {
+				if _, e := write(latest, version); e != nil {
+					err = fmt.Errorf("error writing latest version: %v", e)
+					return false
+				}
+			}
+			if _, e := write(v, nil); e != nil {
+				err = fmt.Errorf("error parsing archived resource version: %v", e)
+				return false
+			}
+			historyLatest = v
+			historyLength++
+			return true
+		})
 		if err != nil {
-			return nil, fmt.Errorf("error hydrating archived version history: %w", err)
+			return err
 		}
-		historyLength = len(history)
+		Debugf(ctx, "fetched %d archived versions", historyLength)
 
 		if historyLength > 0 && version == nil {
 			color.Yellow("using existing resource version from version history...")
-			historyLatest := history[len(history)-1]
 			var v V
 			if err := json.Unmarshal(historyLatest, &v); err != nil {
-				return nil, fmt.Errorf("error parsing history version: %w", err)
-			} else {
-				version = &v
+				return fmt.Errorf("error parsing history version: %w", err)
 			}
+			version = &v
 		}
 	}
 
-	// initialize check versions
-	var versions []V
-
-	// append any archived history retrieved earlier in the operation to list of versions
-	// keep track of versions seen
-	archived := make(map[string]struct{}, historyLength)
-	for _, version := range history {
-		sum := md5.Sum(version)
-		var v V
-		if err := json.Unmarshal(version, &v); err != nil {
-			return nil, fmt.Errorf("error parsing archived resource version: %v", err)
-		}
-		versions = append(versions, v)
-		archived[string(sum[:])] = struct{}{}
-	}
-
 	// execute Check operation
-	newVersions, err := r.Check(ctx, source, version)
+	var newVersions []V
+	err = retry(ctx, CheckOp, func() (err error) {
+		newVersions, err = r.Check(ctx, source, version)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// add returned versions to the result if not present in history
 	var unarchived [][]byte
-	for _, version := range newVersions {
-		serialized, err := json.Marshal(&version)
+	for i := range newVersions {
+		serialized, err := canonical.Marshal(&newVersions[i])
 		if err != nil {
-			return nil, fmt.Errorf("error serializing version for archival: %v", err)
+			return fmt.Errorf("error serializing version for archival: %v", err)
 		}
-		sum := md5.Sum(serialized)
-		if _, seen := archived[string(sum[:])]; !seen {
-			versions = append(versions, version)
-			// keep track of new versions in order to archive
-			if archiver != nil {
-				unarchived = append(unarchived, serialized)
-			}
+		written, err := write(serialized, &newVersions[i])
+		if err != nil {
+			return fmt.Errorf("error writing version: %v", err)
+		}
+		// keep track of new versions in order to archive
+		if archiver != nil && written {
+			unarchived = append(unarchived, serialized)
 		}
 	}
 
 	// archive new versions emitted by check operations
+	Debugf(ctx, "check returned %d versions, %d new", len(newVersions), len(unarchived))
 	if archiver != nil && len(unarchived) > 0 {
 		if err := archiver.Put(ctx, unarchived...); err != nil {
-			return nil, fmt.Errorf("error archiving new versions: %v", err)
+			return fmt.Errorf("error archiving new versions: %v", err)
 		}
 	}
-	return versions, nil
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error writing response: %v", err)
+	}
+	return nil
 }
 
 // in executes an In operation on the provided resource
-func in[S any, V any, G any, P any](ctx context.Context, r Resource[S, V, G, P], source *S, version *V, path string, getParams gjson.Result) (*Response[V], error) {
+func in[S any, V any, G any](ctx context.Context, r Getter[S, V, G], archiver Archive, source *S, version *V, path string, getParams gjson.Result) (*Response[V], error) {
 	errs := multierror.Append(nil)
 
 	// verify version is not nil
@@ -332,11 +494,10 @@ func in[S any, V any, G any, P any](ctx context.Context, r Resource[S, V, G, P],
 	// parse params
 	var params *G
 	if getParams.Exists() && getParams.Type != gjson.Null {
-		var p G
-		if err := json.Unmarshal([]byte(getParams.Raw), &p); err != nil {
+		if p, err := decode[G](ctx, getParams); err != nil {
 			errs = multierror.Append(errs, fmt.Errorf("error parsing get parameters: %w", err))
 		} else {
-			params = &p
+			params = p
 		}
 	}
 
@@ -354,28 +515,56 @@ func in[S any, V any, G any, P any](ctx context.Context, r Resource[S, V, G, P],
 	}
 
 	// execute In
-	meta, err := r.In(ctx, source, version, path, params)
+	var meta []Metadata
+	err := retry(ctx, InOp, func() (err error) {
+		meta, err = r.In(ctx, source, version, path, params)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+
+	// fall back to metadata archived by a previous put step if the resource
+	// returns none
+	if archiver != nil && len(meta) == 0 {
+		if archived, err := archivedMetadata(ctx, archiver, version); err != nil {
+			color.Yellow("error retrieving archived metadata: %v", err)
+		} else if archived != nil {
+			Debugf(ctx, "using %d archived metadata entries", len(archived))
+			meta = archived
+		}
+	}
+
 	return &Response[V]{
 		Version:  version,
 		Metadata: meta,
 	}, nil
 }
 
+// archivedMetadata returns the metadata archived alongside the given version
+func archivedMetadata[V any](ctx context.Context, archiver Archive, version *V) ([]Metadata, error) {
+	serialized, err := canonical.Marshal(version)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing version: %w", err)
+	}
+	meta, err := archive.GetMetadata(ctx, archiver, serialized)
+	if err != nil {
+		return nil, err
+	}
+	return fromArchiveMetadata(meta), nil
+}
+
 // out executes an Out operation on the provided resource
-func out[S any, V any, G any, P any](ctx context.Context, r Resource[S, V, G, P], archiver Archive, source *S, path string, putParams gjson.Result) (*Response[V], error) {
+func out[S any, V any, P any](ctx context.Context, r Putter[S, V, P], archiver Archive, source *S, path string, putParams gjson.Result) (*Response[V], error) {
 	var errs error
 
 	// parse params
 	var params *P
 	if putParams.Exists() && putParams.Type != gjson.Null {
-		var p P
-		if err := json.Unmarshal([]byte(putParams.Raw), &p); err != nil {
+		if p, err := decode[P](ctx, putParams); err != nil {
 			errs = errors.Join(errs, fmt.Errorf("error parsing get parameters: %w", err))
 		} else {
-			params = &p
+			params = p
 		}
 	}
 
@@ -399,7 +588,7 @@ func out[S any, V any, G any, P any](ctx context.Context, r Resource[S, V, G, P]
 	}
 
 	// validate returned version
-	serialized, err := json.Marshal(&version)
+	serialized, err := canonical.Marshal(&version)
 	if err != nil {
 		return nil, fmt.Errorf("error serializing version as json: %w", err)
 	}
@@ -424,7 +613,7 @@ func out[S any, V any, G any, P any](ctx context.Context, r Resource[S, V, G, P]
 		if err != nil {
 			return nil, fmt.Errorf("error serializing version for archival: %v", err)
 		}
-		if err := archiver.Put(ctx, serialized); err != nil {
+		if err := archive.PutMetadata(ctx, archiver, serialized, toArchiveMetadata(meta)); err != nil {
 			color.Red("error archiving new version: %v", err)
 			return nil, fmt.Errorf("error archiving new version: %v", err)
 		}
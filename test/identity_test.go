@@ -0,0 +1,168 @@
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sdk "github.com/cludden/concourse-go-sdk"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/file"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestIdentity(t *testing.T) {
+	type Common struct {
+		Team string `json:"team" archive:"identity"`
+	}
+
+	type Source struct {
+		Common
+		sdk.ArchiveSource
+		Repository string `json:"repository" archive:"identity"`
+		Branch     string `json:"branch,omitempty" archive:"identity"`
+		Token      string `json:"token"`
+	}
+
+	// identities are stable and ignore untagged fields
+	a, err := sdk.Identity(&Source{Common: Common{Team: "main"}, Repository: "foo", Token: "a"})
+	assert.NoError(t, err)
+	assert.Len(t, a, 16)
+	b, err := sdk.Identity(Source{Common: Common{Team: "main"}, Repository: "foo", Token: "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, a, b)
+
+	// identities differ when any tagged field differs
+	c, err := sdk.Identity(&Source{Common: Common{Team: "main"}, Repository: "foo", Branch: "main"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, a, c)
+	d, err := sdk.Identity(&Source{Common: Common{Team: "other"}, Repository: "foo"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, a, d)
+
+	// sources without tagged fields have no identity
+	e, err := sdk.Identity(&struct {
+		URI string `json:"uri"`
+	}{URI: "foo"})
+	assert.NoError(t, err)
+	assert.Empty(t, e)
+	f, err := sdk.Identity((*Source)(nil))
+	assert.NoError(t, err)
+	assert.Empty(t, f)
+
+	// tagged fields must be exported and have unique names
+	_, err = sdk.Identity(&struct {
+		uri string `archive:"identity"`
+	}{})
+	assert.EqualError(t, err, "invalid identity field uri: field must be exported")
+	_, err = sdk.Identity(&struct {
+		Common
+		Team string `json:"team" archive:"identity"`
+	}{})
+	assert.EqualError(t, err, "invalid identity field Team: duplicate name team")
+}
+
+func TestExecArchiveNamespace(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	r := &namespacedResource{}
+	check := func(repository, namespace string, versions ...string) (gjson.Result, string, error) {
+		r.versions = versions
+		var stdout, stderr bytes.Buffer
+		req := fmt.Sprintf(`{"source":{"repository":%q,"archive":{"namespace":%q,"file":{"path":%q}}},"version":null}`, repository, namespace, path)
+		err := sdk.Exec[namespacedSource, Version, GetParams, PutParams](ctx, sdk.CheckOp, r, strings.NewReader(req), &stdout, &stderr, []string{"/opt/resource/check"})
+		return gjson.ParseBytes(stdout.Bytes()), stderr.String(), err
+	}
+
+	// resources with distinct identities share storage without sharing history
+	result, stderr, err := check("foo", "", "1")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"qux":"1"}]`, result.Raw)
+	foo, err := sdk.Identity(&namespacedSource{Repository: "foo"})
+	assert.NoError(t, err)
+	assert.Contains(t, stderr, "using archive namespace "+foo+", derived from source fields: repository")
+
+	result, _, err = check("bar", "", "2")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"qux":"2"}]`, result.Raw)
+
+	result, _, err = check("foo", "")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"qux":"1"}]`, result.Raw)
+
+	// explicitly configured namespaces take precedence
+	result, _, err = check("foo", foo+"x")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[]`, result.Raw)
+	result, _, err = check("bar", foo)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"qux":"1"}]`, result.Raw)
+}
+
+func TestExecArchiveLegacyNamespace(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	r := &namespacedResource{}
+	check := func(versions ...string) (gjson.Result, string, error) {
+		r.versions = versions
+		var stdout, stderr bytes.Buffer
+		req := fmt.Sprintf(`{"source":{"repository":"foo","archive":{"file":{"path":%q}}},"version":null}`, path)
+		err := sdk.Exec[namespacedSource, Version, GetParams, PutParams](ctx, sdk.CheckOp, r, strings.NewReader(req), &stdout, &stderr, []string{"/opt/resource/check"})
+		return gjson.ParseBytes(stdout.Bytes()), stderr.String(), err
+	}
+
+	// seed history archived before the resource identity was introduced
+	a, err := file.New(ctx, file.Config{Path: path}, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Put(ctx, []byte(`{"qux":"0"}`)))
+	assert.NoError(t, a.Close(ctx))
+
+	// un-namespaced history is copied into empty namespaces, which receive all
+	// subsequent writes
+	result, stderr, err := check("1")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"qux":"0"},{"qux":"1"}]`, result.Raw)
+	assert.Contains(t, stderr, "copied 1 version(s) archived without a namespace")
+	a, err = file.New(ctx, file.Config{Path: path}, &settings.Settings{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	legacy, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"qux":"0"}`)}, legacy)
+	assert.NoError(t, a.Close(ctx))
+
+	// history is copied only once
+	result, stderr, err = check("2")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"qux":"0"},{"qux":"1"},{"qux":"2"}]`, result.Raw)
+	assert.NotContains(t, stderr, "archived without a namespace")
+}
+
+// namespacedSource describes a source whose archived history is namespaced by
+// repository
+type namespacedSource struct {
+	sdk.ArchiveSource
+	Repository string `json:"repository" archive:"identity"`
+}
+
+// namespacedResource implements a check-only resource using namespacedSource
+type namespacedResource struct {
+	sdk.UnsupportedGet[namespacedSource, Version, GetParams]
+	sdk.UnsupportedPut[namespacedSource, Version, PutParams]
+	versions []string
+}
+
+func (r *namespacedResource) Check(ctx context.Context, s *namespacedSource, v *Version) ([]Version, error) {
+	versions := make([]Version, len(r.versions))
+	for i, qux := range r.versions {
+		versions[i] = Version{Qux: qux}
+	}
+	return versions, nil
+}
@@ -0,0 +1,135 @@
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	sdk "github.com/cludden/concourse-go-sdk"
+	"github.com/cludden/concourse-go-sdk/pkg/archive"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/boltdb"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/file"
+	"github.com/cludden/concourse-go-sdk/pkg/archive/settings"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestExecArchiveLock(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	r := &namespacedResource{versions: []string{"1"}}
+	check := func() (gjson.Result, string, error) {
+		var stdout, stderr bytes.Buffer
+		req := fmt.Sprintf(`{"source":{"repository":"foo","archive":{"namespace":"test","lock":{"wait":"300ms"},"file":{"path":%q}}},"version":null}`, path)
+		err := sdk.Exec[namespacedSource, Version, GetParams, PutParams](ctx, sdk.CheckOp, r, strings.NewReader(req), &stdout, &stderr, []string{"/opt/resource/check"})
+		return gjson.ParseBytes(stdout.Bytes()), stderr.String(), err
+	}
+
+	// hold the archive lock on behalf of another step
+	a, err := file.New(ctx, file.Config{Path: path}, &settings.Settings{Namespace: "test"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close(ctx)
+	lease, err := archive.Lock(ctx, a, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// checks wait for the lock, failing once the configured wait elapses
+	_, stderr, err := check()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "error locking archive: timed out after 300ms waiting for archive lock held by ")
+	}
+	assert.Contains(t, stderr, "waiting up to ")
+
+	// checks succeed once the lock is released, and release the lock when
+	// complete
+	assert.NoError(t, lease.Release(ctx))
+	result, _, err := check()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"qux":"1"}]`, result.Raw)
+	lease, err = a.TryLock(ctx, archive.LockRequest{Owner: "test"})
+	if assert.NoError(t, err) {
+		assert.NoError(t, lease.Release(ctx))
+	}
+}
+
+func TestExecArchiveLockRefresh(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	ctx := context.Background()
+	cfg := boltdb.Config{
+		Bucket:      fmt.Sprintf("test-lock-%d", time.Now().UnixNano()),
+		Credentials: &boltdb.Credentials{AccessKey: "abc", SecretKey: "123"},
+		Endpoint:    "http://localhost:4566",
+		Key:         "archive.db",
+		Region:      "us-east-1",
+	}
+	sess, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(cfg.Region),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfg.Credentials.AccessKey, cfg.Credentials.SecretKey, "")),
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	client := s3.NewFromConfig(sess, s3.WithEndpointResolver(s3.EndpointResolverFromURL(cfg.Endpoint)), func(o *s3.Options) {
+		o.UsePathStyle = true
+	})
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: &cfg.Bucket}); !assert.NoError(t, err) {
+		return
+	}
+
+	// hold the archive lock on behalf of another step
+	a, err := boltdb.New(ctx, cfg, &settings.Settings{Namespace: "test"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	lease, err := archive.Lock(ctx, a, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// start a check, which opens the archive before waiting for the lock
+	raw, err := json.Marshal(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	done := make(chan error, 1)
+	var stdout, stderr bytes.Buffer
+	go func() {
+		r := &namespacedResource{versions: []string{"2"}}
+		req := fmt.Sprintf(`{"source":{"repository":"foo","archive":{"namespace":"test","boltdb":%s}},"version":null}`, raw)
+		done <- sdk.Exec[namespacedSource, Version, GetParams, PutParams](ctx, sdk.CheckOp, r, strings.NewReader(req), &stdout, &stderr, []string{"/opt/resource/check"})
+	}()
+
+	// versions archived by the holder are included once the check acquires
+	// the lock
+	time.Sleep(500 * time.Millisecond)
+	assert.NoError(t, a.Put(ctx, []byte(`{"qux":"1"}`)))
+	assert.NoError(t, a.Close(ctx))
+	assert.NoError(t, lease.Release(ctx))
+	if !assert.NoError(t, <-done) {
+		return
+	}
+	assert.JSONEq(t, `[{"qux":"1"},{"qux":"2"}]`, stdout.String())
+
+	a, err = boltdb.New(ctx, cfg, &settings.Settings{Namespace: "test"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close(ctx)
+	versions, err := a.History(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"qux":"1"}`), []byte(`{"qux":"2"}`)}, versions)
+}
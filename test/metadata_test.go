@@ -0,0 +1,78 @@
+package testutil
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	sdk "github.com/cludden/concourse-go-sdk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMetadata(t *testing.T) {
+	type Common struct {
+		BuildID int `metadata:"build_id"`
+	}
+
+	type Meta struct {
+		Common
+		Commit    string        `metadata:"commit"`
+		Author    string        `metadata:"author,omitempty"`
+		Committed time.Time     `metadata:"committed,format=2006-01-02"`
+		Pushed    *time.Time    `metadata:",omitempty"`
+		Duration  time.Duration `metadata:"duration"`
+		CommitURL *url.URL
+		Ratio     float64 `metadata:"ratio"`
+		Tags      []string
+		Internal  string `metadata:"-"`
+		hidden    string
+	}
+
+	u, _ := url.Parse("https://example.com/commit/abc")
+	meta, err := sdk.NewMetadata(&Meta{
+		Common:    Common{BuildID: 42},
+		Commit:    "abc",
+		Committed: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration:  90 * time.Second,
+		CommitURL: u,
+		Ratio:     0.25,
+		Tags:      []string{"a", "b"},
+		Internal:  "secret",
+		hidden:    "hidden",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []sdk.Metadata{
+		{Name: "build_id", Value: "42"},
+		{Name: "commit", Value: "abc"},
+		{Name: "committed", Value: "2023-01-02"},
+		{Name: "duration", Value: "1m30s"},
+		{Name: "commit_url", Value: "https://example.com/commit/abc"},
+		{Name: "ratio", Value: "0.25"},
+		{Name: "tags", Value: "a, b"},
+	}, meta)
+
+	meta, err = sdk.NewMetadata(struct {
+		Long  string `metadata:"long"`
+		Extra string `metadata:"extra"`
+	}{Long: strings.Repeat("é", 10), Extra: "x"}, sdk.WithMetadataMaxValueLength(10), sdk.WithMetadataMaxEntries(1))
+	assert.NoError(t, err)
+	assert.Equal(t, []sdk.Metadata{{Name: "long", Value: "ééé..."}}, meta)
+
+	// nil embedded struct pointers are skipped, while non-nil pointers are
+	// flattened in place
+	type Pointers struct {
+		*Common
+		*url.URL `metadata:"-"`
+		Commit   string `metadata:"commit"`
+	}
+	meta, err = sdk.NewMetadata(Pointers{Commit: "abc"})
+	assert.NoError(t, err)
+	assert.Equal(t, []sdk.Metadata{{Name: "commit", Value: "abc"}}, meta)
+	meta, err = sdk.NewMetadata(Pointers{Common: &Common{BuildID: 7}, Commit: "abc"})
+	assert.NoError(t, err)
+	assert.Equal(t, []sdk.Metadata{{Name: "build_id", Value: "7"}, {Name: "commit", Value: "abc"}}, meta)
+
+	_, err = sdk.NewMetadata("foo")
+	assert.Error(t, err)
+}
@@ -3,7 +3,11 @@ package testutil
 import (
 	"bytes"
 	context "context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	sdk "github.com/cludden/concourse-go-sdk"
@@ -82,6 +86,141 @@ func TestExec(t *testing.T) {
 				assert.NoError(t, err)
 			},
 		},
+		"archive_canonical_history": {
+			operation: sdk.CheckOp,
+			req:       []byte(`{"source":{},"version":null}`),
+			resource: func(t *testing.T) sdk.Resource[Source, Version, GetParams, PutParams] {
+				r := NewMockResource(t)
+				r.On("Initialize", mock.Anything, mock.AnythingOfType("*testutil.Source")).Return(nil)
+				r.On("Close", mock.Anything).Return(nil)
+				r.On("Archive", mock.Anything, mock.Anything).
+					Return(
+						func(ctx context.Context, s *Source) sdk.Archive {
+							a := mocks.NewArchive(t)
+							a.On("History", mock.Anything, mock.Anything).
+								Return(
+									[][]byte{
+										[]byte(`{"qux":"1"}`),
+										[]byte(`{ "qux": "\u0031" }`),
+									},
+									nil,
+								)
+							a.On("Close", mock.Anything).Return(nil)
+							return a
+						},
+						nil,
+					)
+				r.On("Check", mock.Anything, mock.Anything, mock.Anything).
+					Return([]Version{{Qux: "1"}}, nil)
+				return r
+			},
+			assert: func(t *testing.T, resource any, result *gjson.Result, err error) {
+				assert.NoError(t, err)
+				assert.JSONEq(t, `[{"qux":"1"}]`, result.Raw)
+			},
+		},
+		"archive_source": {
+			operation: sdk.CheckOp,
+			req:       []byte(`{"source":{"archive":{"inmem":{"history":["{\"qux\":\"1\"}"]}}},"version":null}`),
+			resource: func(t *testing.T) sdk.Resource[Source, Version, GetParams, PutParams] {
+				return &checkOnlyResource{versions: []Version{{Qux: "1"}, {Qux: "2"}}}
+			},
+			assert: func(t *testing.T, resource any, result *gjson.Result, err error) {
+				assert.NoError(t, err)
+				assert.JSONEq(t, `[{"qux":"1"},{"qux":"2"}]`, result.Raw)
+				assert.Equal(t, &Version{Qux: "1"}, resource.(*checkOnlyResource).latest)
+			},
+		},
+		"archive_incremental": {
+			operation: sdk.CheckOp,
+			req:       []byte(`{"source":{"archive":{"incremental":true,"inmem":{"history":["{\"qux\":\"1\"}","{\"qux\":\"2\"}","{\"qux\":\"3\"}"]}}},"version":{"qux":"2"}}`),
+			resource: func(t *testing.T) sdk.Resource[Source, Version, GetParams, PutParams] {
+				return &checkOnlyResource{versions: []Version{{Qux: "2"}, {Qux: "4"}}}
+			},
+			assert: func(t *testing.T, resource any, result *gjson.Result, err error) {
+				assert.NoError(t, err)
+				assert.JSONEq(t, `[{"qux":"2"},{"qux":"3"},{"qux":"4"}]`, result.Raw)
+				assert.Equal(t, &Version{Qux: "2"}, resource.(*checkOnlyResource).latest)
+			},
+		},
+		"archive_incremental_force_history": {
+			operation: sdk.CheckOp,
+			req:       []byte(`{"source":{"archive":{"force_history":true,"incremental":true,"inmem":{}}},"version":null}`),
+			resource: func(t *testing.T) sdk.Resource[Source, Version, GetParams, PutParams] {
+				return &checkOnlyResource{}
+			},
+			assert: func(t *testing.T, resource any, result *gjson.Result, err error) {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), "Incremental")
+			},
+		},
+		"check_empty": {
+			operation: sdk.CheckOp,
+			req:       []byte(`{"source":{"archive":{"inmem":{}}},"version":null}`),
+			resource: func(t *testing.T) sdk.Resource[Source, Version, GetParams, PutParams] {
+				return &checkOnlyResource{}
+			},
+			assert: func(t *testing.T, resource any, result *gjson.Result, err error) {
+				assert.NoError(t, err)
+				assert.JSONEq(t, `[]`, result.Raw)
+			},
+		},
+		"sdk_strict": {
+			operation: sdk.CheckOp,
+			req:       []byte(`{"source":{"sdk":{"strict":true},"archive":null,"unknown":"foo"},"version":null}`),
+			resource: func(t *testing.T) sdk.Resource[Source, Version, GetParams, PutParams] {
+				return &checkOnlyResource{}
+			},
+			assert: func(t *testing.T, resource any, result *gjson.Result, err error) {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), `error parsing source: json: unknown field "unknown"`)
+				}
+			},
+		},
+		"sdk_retry": {
+			operation: sdk.CheckOp,
+			req:       []byte(`{"source":{"sdk":{"debug":true,"retry":{"attempts":3,"delay":"1ms"}}},"version":null}`),
+			resource: func(t *testing.T) sdk.Resource[Source, Version, GetParams, PutParams] {
+				return &checkOnlyResource{failures: 2, versions: []Version{{Qux: "1"}}}
+			},
+			assert: func(t *testing.T, resource any, result *gjson.Result, err error) {
+				assert.NoError(t, err)
+				assert.JSONEq(t, `[{"qux":"1"}]`, result.Raw)
+				assert.Equal(t, 0, resource.(*checkOnlyResource).failures)
+			},
+		},
+		"sdk_retry_exhausted": {
+			operation: sdk.CheckOp,
+			req:       []byte(`{"source":{"sdk":{"retry":{"attempts":2,"delay":"1ms"}}},"version":null}`),
+			resource: func(t *testing.T) sdk.Resource[Source, Version, GetParams, PutParams] {
+				return &checkOnlyResource{failures: 3}
+			},
+			assert: func(t *testing.T, resource any, result *gjson.Result, err error) {
+				assert.EqualError(t, err, "check failed")
+				assert.Equal(t, 1, resource.(*checkOnlyResource).failures)
+			},
+		},
+		"check_unsupported": {
+			operation: sdk.CheckOp,
+			req:       []byte(`{"source":{}}`),
+			resource: func(t *testing.T) sdk.Resource[Source, Version, GetParams, PutParams] {
+				return &putOnlyResource{}
+			},
+			assert: func(t *testing.T, resource any, result *gjson.Result, err error) {
+				assert.EqualError(t, err, "this resource does not support check")
+			},
+		},
+		"put_only": {
+			operation: sdk.OutOp,
+			req:       []byte(`{"source":{},"params":{"bar":"2"}}`),
+			resource: func(t *testing.T) sdk.Resource[Source, Version, GetParams, PutParams] {
+				return &putOnlyResource{}
+			},
+			assert: func(t *testing.T, resource any, result *gjson.Result, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "2", result.Get("version.qux").String())
+			},
+		},
 		"check_null_version_no_history": {
 			operation: sdk.CheckOp,
 			req:       []byte(`{"source":{},"version":null}`),
@@ -138,3 +277,129 @@ func TestExec(t *testing.T) {
 		})
 	}
 }
+
+// putOnlyResource implements a resource that only supports put steps
+type putOnlyResource struct {
+	sdk.UnsupportedCheck[Source, Version]
+	sdk.UnsupportedGet[Source, Version, GetParams]
+}
+
+func (r *putOnlyResource) Out(ctx context.Context, s *Source, path string, p *PutParams) (Version, []sdk.Metadata, error) {
+	return Version{Qux: p.Bar}, nil, nil
+}
+
+// checkOnlyResource implements a resource that only supports check operations
+type checkOnlyResource struct {
+	sdk.UnsupportedGet[Source, Version, GetParams]
+	sdk.UnsupportedPut[Source, Version, PutParams]
+	failures int
+	latest   *Version
+	versions []Version
+}
+
+func (r *checkOnlyResource) Check(ctx context.Context, s *Source, v *Version) ([]Version, error) {
+	if r.failures > 0 {
+		r.failures--
+		return nil, errors.New("check failed")
+	}
+	r.latest = v
+	return r.versions, nil
+}
+
+func TestExecBaseResource(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	r := &baseResource{}
+	err := sdk.Exec[Source, Version, GetParams, PutParams](context.Background(), sdk.CheckOp, r, strings.NewReader(`{"source":{},"version":null}`), &stdout, &stderr, []string{"/opt/resource/check"})
+	assert.EqualError(t, err, "this resource does not support check")
+	assert.Empty(t, stdout.String())
+
+	stdout.Reset()
+	err = sdk.Exec[Source, Version, GetParams, PutParams](context.Background(), sdk.OutOp, r, strings.NewReader(`{"source":{},"params":{"bar":"baz"}}`), &stdout, &stderr, []string{"/opt/resource/out", t.TempDir()})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"version":{"qux":"baz"},"metadata":null}`, stdout.String())
+}
+
+// baseResource implements a put-only resource using the deprecated
+// BaseResource stubs for all other operations
+type baseResource struct {
+	sdk.BaseResource[Source, Version, GetParams, PutParams]
+}
+
+func (r *baseResource) Out(ctx context.Context, s *Source, path string, p *PutParams) (Version, []sdk.Metadata, error) {
+	return Version{Qux: p.Bar}, nil, nil
+}
+
+func TestExecArchivedMetadata(t *testing.T) {
+	ctx := context.Background()
+	source := fmt.Sprintf(`{"archive":{"file":{"path":%q}},"sdk":{"archived_metadata":true}}`, filepath.Join(t.TempDir(), "archive.jsonl"))
+	r := &metadataResource{}
+	exec := func(op sdk.Op, req string, args ...string) (gjson.Result, error) {
+		var stdout, stderr bytes.Buffer
+		err := sdk.Exec[Source, Version, GetParams, PutParams](ctx, op, r, strings.NewReader(req), &stdout, &stderr, append(args, t.TempDir()))
+		return gjson.ParseBytes(stdout.Bytes()), err
+	}
+
+	// put steps archive metadata alongside the new version
+	r.meta = []sdk.Metadata{{Name: "commit", Value: "abc123"}}
+	result, err := exec(sdk.OutOp, `{"source":`+source+`,"params":{"bar":"1"}}`, "/opt/resource/out")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, `[{"Name":"commit","Value":"abc123"}]`, result.Get("metadata").Raw)
+
+	// get steps prefer metadata returned by the resource
+	r.meta = []sdk.Metadata{{Name: "commit", Value: "def456"}}
+	result, err = exec(sdk.InOp, `{"source":`+source+`,"version":{"qux":"1"}}`, "/opt/resource/in")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"Name":"commit","Value":"def456"}]`, result.Get("metadata").Raw)
+
+	// get steps fall back to archived metadata
+	r.meta = nil
+	result, err = exec(sdk.InOp, `{"source":`+source+`,"version":{"qux":"1"}}`, "/opt/resource/in")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"Name":"commit","Value":"abc123"}]`, result.Get("metadata").Raw)
+
+	// versions without archived metadata return no metadata
+	result, err = exec(sdk.InOp, `{"source":`+source+`,"version":{"qux":"2"}}`, "/opt/resource/in")
+	assert.NoError(t, err)
+	assert.Equal(t, "null", result.Get("metadata").Raw)
+}
+
+// metadataResource implements a resource that returns the configured
+// metadata from get and put steps
+type metadataResource struct {
+	sdk.UnsupportedCheck[Source, Version]
+	meta []sdk.Metadata
+}
+
+func (r *metadataResource) In(ctx context.Context, s *Source, v *Version, path string, p *GetParams) ([]sdk.Metadata, error) {
+	return r.meta, nil
+}
+
+func (r *metadataResource) Out(ctx context.Context, s *Source, path string, p *PutParams) (Version, []sdk.Metadata, error) {
+	return Version{Qux: p.Bar}, r.meta, nil
+}
+
+func TestExecCheckErrorOutput(t *testing.T) {
+	// archive enough history to exceed any output buffering
+	history := make([]string, 1000)
+	for i := range history {
+		history[i] = fmt.Sprintf(`{"qux":"%d"}`, i)
+	}
+	b, err := json.Marshal(history)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req := fmt.Sprintf(`{"source":{"archive":{"inmem":{"history":%s}}},"version":null}`, b)
+
+	// archived history streamed before a failed check is discarded
+	var stdout, stderr bytes.Buffer
+	err = sdk.Exec[Source, Version, GetParams, PutParams](context.Background(), sdk.CheckOp, &checkOnlyResource{failures: 1}, strings.NewReader(req), &stdout, &stderr, []string{"/opt/resource/check"})
+	assert.EqualError(t, err, "check failed")
+	assert.Empty(t, stdout.String())
+
+	stdout.Reset()
+	err = sdk.Exec[Source, Version, GetParams, PutParams](context.Background(), sdk.CheckOp, &checkOnlyResource{}, strings.NewReader(req), &stdout, &stderr, []string{"/opt/resource/check"})
+	assert.NoError(t, err)
+	assert.Len(t, gjson.Parse(stdout.String()).Array(), 1000)
+}
@@ -0,0 +1,71 @@
+package sdk
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// arrayWriter streams values as a json array to a temporary spool file,
+// without requiring the entire array to be held in memory, and copies the
+// completed array to the underlying writer on Close. This ensures that
+// nothing is written to the underlying writer if an error occurs before the
+// array is complete.
+type arrayWriter struct {
+	dst   io.Writer
+	n     int
+	spool *os.File
+	w     *bufio.Writer
+}
+
+// newArrayWriter returns an arrayWriter that writes to dst
+func newArrayWriter(dst io.Writer) (*arrayWriter, error) {
+	spool, err := os.CreateTemp("", "concourse-check-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("error creating response spool file: %v", err)
+	}
+	return &arrayWriter{dst: dst, spool: spool, w: bufio.NewWriter(spool)}, nil
+}
+
+// Close terminates the json array and copies it to the underlying writer
+func (a *arrayWriter) Close() error {
+	if a.n == 0 {
+		a.w.WriteByte('[')
+	}
+	a.w.WriteString("]\n")
+	if err := a.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := a.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(a.dst, a.spool)
+	return err
+}
+
+// Discard removes the spool file, discarding the array if it has not been
+// written by Close
+func (a *arrayWriter) Discard() {
+	a.spool.Close()
+	os.Remove(a.spool.Name())
+}
+
+// Write appends a json serialized value to the array
+func (a *arrayWriter) Write(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sep := byte(',')
+	if a.n == 0 {
+		sep = '['
+	}
+	a.w.WriteByte(sep)
+	if _, err := a.w.Write(b); err != nil {
+		return err
+	}
+	a.n++
+	return nil
+}